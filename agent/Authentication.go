@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Hex secret of the build, proved with an HMAC of the controller challenge
+var buildSecret string
+
+// authenticate sends the CONNECT request and answers the challenge of the
+// controller, the session starts once it is accepted.
+func (a *Agent) authenticate() error {
+	a.conn.SetDeadline(time.Now().Add(connTimeout))
+	defer a.conn.SetDeadline(time.Time{})
+
+	_, err := a.conn.Write([]byte("CONNECT / HTTP/1.1\nBuild: " + buildId + "\n\n"))
+	if err != nil {
+		return err
+	}
+
+	line, err := a.readLine()
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(line, "Challenge:") {
+		return errors.New("")
+	}
+
+	nonce, err := hex.DecodeString(strings.TrimSpace(strings.TrimPrefix(line, "Challenge:")))
+	if err != nil {
+		return err
+	}
+
+	secret, err := hex.DecodeString(buildSecret)
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	mac.Write([]byte(buildId))
+
+	_, err = a.conn.Write([]byte("Response: " + hex.EncodeToString(mac.Sum(nil)) + "\n"))
+	if err != nil {
+		return err
+	}
+
+	line, err = a.readLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "HTTP/1.1 200") {
+		return errors.New("")
+	}
+
+	for line != "" {
+		line, err = a.readLine()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLine reads a line byte by byte, a buffered reader would take the
+// first frames of the session.
+func (a *Agent) readLine() (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		_, err := a.conn.Read(b)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimRight(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+}
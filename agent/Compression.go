@@ -0,0 +1,145 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	compressionNone = ""
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func newCompressWriter(writer io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case compressionNone:
+		return nopWriteCloser{writer}, nil
+	case compressionGzip:
+		return gzip.NewWriter(writer), nil
+	case compressionZstd:
+		return zstd.NewWriter(writer)
+	}
+	return nil, errors.New("unknown compression " + compression)
+}
+
+func newDecompressReader(reader io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case compressionNone:
+		return ioutil.NopCloser(reader), nil
+	case compressionGzip:
+		return gzip.NewReader(reader)
+	case compressionZstd:
+		decoder, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, errors.New("unknown compression " + compression)
+}
+
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newFlushWriter(writer io.Writer, compression string) (flushWriteCloser, error) {
+	switch compression {
+	case compressionGzip:
+		return gzip.NewWriter(writer), nil
+	case compressionZstd:
+		return zstd.NewWriter(writer)
+	}
+	return nil, errors.New("unknown compression " + compression)
+}
+
+// compressedStream compresses what is written to a stream and decompresses
+// what is read from it. Writes to interactive streams are flushed at once,
+// bulk streams are flushed by Flush and Close.
+type compressedStream struct {
+	stream io.ReadWriteCloser
+	compression string
+	interactive bool
+	reader io.ReadCloser
+	writer flushWriteCloser
+}
+
+func (c *compressedStream) Read(data []byte) (int, error) {
+	if c.reader == nil {
+		var err error
+		c.reader, err = newDecompressReader(c.stream, c.compression)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := c.reader.Read(data)
+	return n, err
+}
+
+func (c *compressedStream) Write(data []byte) (int, error) {
+	if c.writer == nil {
+		var err error
+		c.writer, err = newFlushWriter(c.stream, c.compression)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := c.writer.Write(data)
+	if err != nil || !c.interactive {
+		return n, err
+	}
+	return n, c.writer.Flush()
+}
+
+func (c *compressedStream) Flush() error {
+	if c.writer == nil {
+		return nil
+	}
+	return c.writer.Flush()
+}
+
+func (c *compressedStream) Close() error {
+	if c.writer != nil {
+		c.writer.Close()
+	}
+	if c.reader != nil {
+		c.reader.Close()
+	}
+	return c.stream.Close()
+}
+
+// Requests whose streams are flushed on each write
+var interactiveStreams = []string{"execute", "shell"}
+
+func newDataStream(stream io.ReadWriteCloser, compression string, interactive bool) io.ReadWriteCloser {
+	if compression == compressionNone {
+		return stream
+	}
+	return &compressedStream{stream: stream, compression: compression, interactive: interactive}
+}
+
+func isInteractiveStream(requestType string) bool {
+	for _, stream := range interactiveStreams {
+		if stream == requestType {
+			return true
+		}
+	}
+	return false
+}
+
+// supportedCompressions is announced to the controller in the handshake.
+var supportedCompressions = []string{compressionZstd, compressionGzip}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"time"
+)
+
+// Why a command was killed
+const (
+	stopCanceled = 1
+	stopTimedOut = 2
+)
+
+func (a *Agent) execute(request *Request) (interface{}, error) {
+
+	var params CommandParams
+	err := request.Params(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := request.OpenDataStream("stdout")
+	if err != nil {
+		return nil, err
+	}
+
+	defer stdout.Close()
+
+	stderr, err := request.OpenDataStream("stderr")
+	if err != nil {
+		return nil, err
+	}
+
+	defer stderr.Close()
+
+	cmd := shellCommand(params.Command)
+	cmd.Dir = request.Cwd
+	cmd.Env = request.environ(os.Environ())
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	var stopped int32
+	stop := func(reason int32) {
+		if atomic.CompareAndSwapInt32(&stopped, 0, reason) {
+			killCommand(cmd)
+		}
+	}
+
+	request.OnCancel(func() {
+		stop(stopCanceled)
+	})
+
+	if params.Timeout > 0 {
+		timer := time.AfterFunc(time.Duration(params.Timeout)*time.Second, func() {
+			stop(stopTimedOut)
+		})
+		defer timer.Stop()
+	}
+
+	err = cmd.Wait()
+
+	result := &ExecuteResult{
+		Canceled: atomic.LoadInt32(&stopped) == stopCanceled,
+		TimedOut: atomic.LoadInt32(&stopped) == stopTimedOut,
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		result.ExitCode = exitErr.ExitCode()
+	} else if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
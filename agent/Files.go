@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+func newFileEntry(path string, info os.FileInfo) FileEntry {
+	owner, group := fileOwner(info)
+	return FileEntry{
+		Name:    info.Name(),
+		Path:    path,
+		Size:    info.Size(),
+		Mode:    info.Mode().String(),
+		IsDir:   info.IsDir(),
+		ModTime: info.ModTime(),
+		Owner:   owner,
+		Group:   group,
+	}
+}
+
+func (a *Agent) getwd(request *Request) (interface{}, error) {
+	if request.Cwd != "" {
+		return &FileParams{Path: request.Cwd}, nil
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	return &FileParams{Path: cwd}, nil
+}
+
+func (a *Agent) listFiles(request *Request) (interface{}, error) {
+	var params FileParams
+	err := request.Params(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := filepath.Abs(request.path(params.Path))
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return []FileEntry{newFileEntry(path, info)}, nil
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer dir.Close()
+
+	infos, err := dir.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+
+	entries := make([]FileEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, newFileEntry(filepath.Join(path, info.Name()), info))
+	}
+	return entries, nil
+}
+
+func (a *Agent) statFile(request *Request) (interface{}, error) {
+	var params FileParams
+	err := request.Params(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := filepath.Abs(request.path(params.Path))
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := newFileEntry(path, info)
+	return &entry, nil
+}
+
+func (a *Agent) makeDir(request *Request) (interface{}, error) {
+	var params FileParams
+	err := request.Params(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Recursive {
+		return nil, os.MkdirAll(request.path(params.Path), 0755)
+	}
+	return nil, os.Mkdir(request.path(params.Path), 0755)
+}
+
+func (a *Agent) removeFile(request *Request) (interface{}, error) {
+	var params FileParams
+	err := request.Params(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Recursive {
+		return nil, os.RemoveAll(request.path(params.Path))
+	}
+	return nil, os.Remove(request.path(params.Path))
+}
+
+func (a *Agent) moveFile(request *Request) (interface{}, error) {
+	var params MoveParams
+	err := request.Params(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Source == "" || params.Destination == "" {
+		return nil, errors.New("source and destination are required")
+	}
+	return nil, os.Rename(request.path(params.Source), request.path(params.Destination))
+}
+
+func (a *Agent) chmodFile(request *Request) (interface{}, error) {
+	var params ChmodParams
+	err := request.Params(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, os.Chmod(request.path(params.Path), os.FileMode(params.Mode))
+}
+
+func (a *Agent) touchFile(request *Request) (interface{}, error) {
+	var params FileParams
+	err := request.Params(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	path := request.path(params.Path)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	now := time.Now()
+	return nil, os.Chtimes(path, now, now)
+}
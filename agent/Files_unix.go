@@ -0,0 +1,28 @@
+// +build linux darwin freebsd netbsd openbsd
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+func fileOwner(info os.FileInfo) (string, string) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", ""
+	}
+
+	owner := strconv.FormatUint(uint64(stat.Uid), 10)
+	group := strconv.FormatUint(uint64(stat.Gid), 10)
+
+	if u, err := user.LookupId(owner); err == nil {
+		owner = u.Username
+	}
+	if g, err := user.LookupGroupId(group); err == nil {
+		group = g.Name
+	}
+	return owner, group
+}
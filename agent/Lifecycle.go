@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// What the agent does once the controller asked it to leave, see serve.
+const (
+	leaveNone = iota
+	leaveDisconnect
+	leaveTerminate
+)
+
+type leaveState struct {
+	sync.Mutex
+	action int
+	delay time.Duration
+}
+
+// leave closes the connection once the reply to request is sent.
+func (a *Agent) leave(request *Request, action int, delay time.Duration) {
+	a.leaving.Lock()
+	a.leaving.action = action
+	a.leaving.delay = delay
+	a.leaving.Unlock()
+
+	request.afterReply = func() {
+		a.conn.Close()
+	}
+}
+
+// left returns what to do after the session and the delay before reconnecting.
+func (a *Agent) left() (int, time.Duration) {
+	a.leaving.Lock()
+	defer a.leaving.Unlock()
+	return a.leaving.action, a.leaving.delay
+}
+
+// disconnect leaves the controller, the agent reconnects after the delay
+// or the reconnect interval.
+func (a *Agent) disconnect(request *Request) (interface{}, error) {
+	var params LifecycleParams
+	err := request.Params(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	a.leave(request, leaveDisconnect, time.Duration(params.Delay)*time.Second)
+	return &LifecycleResult{Pid: os.Getpid()}, nil
+}
+
+func (a *Agent) terminate(request *Request) (interface{}, error) {
+	a.leave(request, leaveTerminate, 0)
+	return &LifecycleResult{Pid: os.Getpid()}, nil
+}
+
+// uninstall removes the executable, the lockfile and the Id file then
+// terminates, the reply tells what was removed.
+func (a *Agent) uninstall(request *Request) (interface{}, error) {
+	result := LifecycleResult{Pid: os.Getpid()}
+
+	executable, err := os.Executable()
+	if err == nil {
+		result.Executable = executable
+		var removed string
+		removed, err = removeExecutable(executable)
+		if err == nil {
+			result.Removed = append(result.Removed, removed)
+		}
+	}
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+	}
+
+	err = agentLock.Unlock()
+	if err == nil {
+		result.Removed = append(result.Removed, string(agentLock))
+	} else {
+		result.Errors = append(result.Errors, err.Error())
+	}
+
+	idFile := getAgentIdFileName()
+	err = os.Remove(idFile)
+	if err == nil {
+		result.Removed = append(result.Removed, idFile)
+	} else if !os.IsNotExist(err) {
+		result.Errors = append(result.Errors, err.Error())
+	}
+
+	a.leave(request, leaveTerminate, 0)
+	return &result, nil
+}
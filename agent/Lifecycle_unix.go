@@ -0,0 +1,10 @@
+// +build !windows
+
+package main
+
+import "os"
+
+// removeExecutable removes the running executable, returns what was removed.
+func removeExecutable(path string) (string, error) {
+	return path, os.Remove(path)
+}
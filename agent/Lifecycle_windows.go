@@ -0,0 +1,24 @@
+// +build windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// removeExecutable can't remove the running executable, it starts a
+// command removing it once the agent exited.
+func removeExecutable(path string) (string, error) {
+	cmd := exec.Command("cmd.exe", "/C", "ping -n 5 127.0.0.1 >nul & del /F /Q \""+path+"\"")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
+		HideWindow: true,
+	}
+
+	err := cmd.Start()
+	if err != nil {
+		return "", err
+	}
+	return path + " (once the agent exited)", nil
+}
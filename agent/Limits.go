@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// Unix time after which the agent exits
+	killDate string
+	// HH:MM-HH:MM in the local time of the agent, it may end the next day
+	operatingHours string
+)
+
+// limits are set at build time. The agent only connects during the
+// operating hours and exits once the kill date is reached.
+type limits struct {
+	killDate time.Time
+	hours bool
+	start time.Duration
+	end time.Duration
+}
+
+func newLimits() limits {
+	var l limits
+
+	if seconds, err := strconv.ParseInt(killDate, 10, 64); err == nil && seconds > 0 {
+		l.killDate = time.Unix(seconds, 0)
+	}
+
+	l.start, l.end, l.hours = parseOperatingHours(operatingHours)
+	return l
+}
+
+func parseOperatingHours(value string) (time.Duration, time.Duration, bool) {
+	bounds := strings.Split(value, "-")
+	if len(bounds) != 2 {
+		return 0, 0, false
+	}
+
+	start, err := parseClock(bounds[0])
+	if err != nil {
+		return 0, 0, false
+	}
+
+	end, err := parseClock(bounds[1])
+	if err != nil || end == start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+func parseClock(value string) (time.Duration, error) {
+	clock, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute, nil
+}
+
+func (l limits) expired(now time.Time) bool {
+	return !l.killDate.IsZero() && !now.Before(l.killDate)
+}
+
+// sleep waits for duration, or until the kill date when it comes first.
+func (l limits) sleep(duration time.Duration) {
+	if !l.killDate.IsZero() {
+		if left := l.killDate.Sub(time.Now()); left < duration {
+			duration = left
+		}
+	}
+	if duration > 0 {
+		time.Sleep(duration)
+	}
+}
+
+// untilWindow returns how long to wait for the operating hours, 0 within them.
+func (l limits) untilWindow(now time.Time) time.Duration {
+	if !l.hours {
+		return 0
+	}
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	clock := now.Sub(midnight)
+
+	if l.start < l.end {
+		if clock < l.start {
+			return l.start - clock
+		}
+		if clock >= l.end {
+			return 24*time.Hour - clock + l.start
+		}
+		return 0
+	}
+
+	// The window ends the next day
+	if clock >= l.end && clock < l.start {
+		return l.start - clock
+	}
+	return 0
+}
+
+// remaining returns how long the agent may stay connected, false when it isn't limited.
+func (l limits) remaining(now time.Time) (time.Duration, bool) {
+	var result time.Duration
+	limited := false
+
+	if !l.killDate.IsZero() {
+		result = l.killDate.Sub(now)
+		limited = true
+	}
+
+	if l.hours {
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		untilEnd := l.end - now.Sub(midnight)
+		if untilEnd <= 0 {
+			untilEnd += 24 * time.Hour
+		}
+		if !limited || untilEnd < result {
+			result = untilEnd
+		}
+		limited = true
+	}
+	return result, limited
+}
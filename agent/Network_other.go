@@ -0,0 +1,11 @@
+// +build !linux
+
+package main
+
+import (
+	"runtime"
+)
+
+func getConnections() ([]Connection, error) {
+	return nil, unsupported("connections listing is not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var userNames = struct {
+	sync.Mutex
+	names map[string]string
+}{names: make(map[string]string)}
+
+// lookupUserName resolves an uid to a name, results are cached because a
+// process listing asks for the same few users again and again.
+func lookupUserName(uid string) string {
+	userNames.Lock()
+	defer userNames.Unlock()
+
+	if name, ok := userNames.names[uid]; ok {
+		return name
+	}
+
+	name := uid
+	if u, err := user.LookupId(uid); err == nil {
+		name = u.Username
+	}
+	userNames.names[uid] = name
+	return name
+}
+
+func lookupUserNameById(uid uint32) string {
+	return lookupUserName(strconv.FormatUint(uint64(uid), 10))
+}
+
+func (a *Agent) listProcesses(request *Request) (interface{}, error) {
+	processes, err := getProcesses()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(processes, func(i, j int) bool {
+		return processes[i].Pid < processes[j].Pid
+	})
+	return processes, nil
+}
+
+func (a *Agent) killProcess(request *Request) (interface{}, error) {
+	var params ProcessParams
+	err := request.Params(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	process, err := os.FindProcess(params.Pid)
+	if err != nil {
+		return nil, err
+	}
+	return nil, process.Kill()
+}
@@ -0,0 +1,73 @@
+// +build freebsd netbsd openbsd
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"golang.org/x/sys/unix"
+	"strings"
+	"unsafe"
+)
+
+// The process tables are read with sysctl. OpenBSD and NetBSD take the size
+// of the records in the request, their layout is the same on every
+// architecture and only grows at the end. FreeBSD records depend on the
+// architecture, see Process_freebsd.go.
+
+// kinfoByteOrder is the byte order of the records, the one of the host.
+var kinfoByteOrder = getHostByteOrder()
+
+func getHostByteOrder() binary.ByteOrder {
+	value := uint16(1)
+	if *(*byte)(unsafe.Pointer(&value)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// readKinfo returns the records of a process table sysctl, it is read
+// again when processes are started between the size and the read.
+func readKinfo(name string, args ...int) ([]byte, error) {
+	var data []byte
+	var err error
+	for i := 0; i < 5; i++ {
+		data, err = unix.SysctlRaw(name, args...)
+		if err != unix.ENOMEM {
+			break
+		}
+	}
+	return data, err
+}
+
+// kinfoLayout gives the offsets of the fields read in the records.
+type kinfoLayout struct {
+	pid int
+	ppid int
+	uid int
+	comm int
+	commSize int
+}
+
+func (l kinfoLayout) process(record []byte) Process {
+	comm := record[l.comm : l.comm + l.commSize]
+	if end := bytes.IndexByte(comm, 0); end >= 0 {
+		comm = comm[:end]
+	}
+
+	return Process{
+		Pid:     int(int32(kinfoByteOrder.Uint32(record[l.pid:]))),
+		Ppid:    int(int32(kinfoByteOrder.Uint32(record[l.ppid:]))),
+		User:    lookupUserNameById(kinfoByteOrder.Uint32(record[l.uid:])),
+		Command: "[" + string(comm) + "]",
+	}
+}
+
+// parseArguments returns the NUL separated arguments as a command line.
+func parseArguments(data []byte) string {
+	data = bytes.TrimRight(data, "\x00")
+	if len(data) == 0 {
+		return ""
+	}
+	return strings.Join(strings.Split(string(data), "\x00"), " ")
+}
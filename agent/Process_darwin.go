@@ -0,0 +1,75 @@
+// +build darwin
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"golang.org/x/sys/unix"
+	"strings"
+	"time"
+)
+
+func getProcesses() ([]Process, error) {
+	kinfos, err := unix.SysctlKinfoProcSlice("kern.proc.all")
+	if err != nil {
+		return nil, err
+	}
+
+	processes := make([]Process, 0, len(kinfos))
+	for _, kinfo := range kinfos {
+		pid := int(kinfo.Proc.P_pid)
+		seconds, nanoseconds := kinfo.Proc.P_starttime.Unix()
+
+		process := Process{
+			Pid:       pid,
+			Ppid:      int(kinfo.Eproc.Ppid),
+			User:      lookupUserNameById(kinfo.Eproc.Ucred.Uid),
+			StartTime: time.Unix(seconds, nanoseconds),
+			Command:   getCommandLine(pid),
+		}
+
+		if process.Command == "" {
+			comm := kinfo.Proc.P_comm[:]
+			if end := bytes.IndexByte(comm, 0); end >= 0 {
+				comm = comm[:end]
+			}
+			process.Command = "[" + string(comm) + "]"
+		}
+
+		processes = append(processes, process)
+	}
+	return processes, nil
+}
+
+// getCommandLine parses kern.procargs2: argc, the executable path, padding
+// and then the NUL separated arguments.
+func getCommandLine(pid int) string {
+	raw, err := unix.SysctlRaw("kern.procargs2", pid)
+	if err != nil || len(raw) < 4 {
+		return ""
+	}
+
+	argc := int(binary.LittleEndian.Uint32(raw[:4]))
+	data := raw[4:]
+
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return ""
+	}
+	data = bytes.TrimLeft(data[end:], "\x00")
+
+	args := make([]string, 0, argc)
+	for len(args) < argc && len(data) > 0 {
+		end = bytes.IndexByte(data, 0)
+		if end < 0 {
+			end = len(data)
+		}
+		args = append(args, string(data[:end]))
+		if end == len(data) {
+			break
+		}
+		data = data[end+1:]
+	}
+	return strings.Join(args, " ")
+}
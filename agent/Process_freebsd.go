@@ -0,0 +1,49 @@
+// +build freebsd
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"runtime"
+	"time"
+	"unsafe"
+)
+
+// struct kinfo_proc of the 64 bits architectures, its size is checked in
+// each record. The 32 bits layouts differ by their time_t.
+const freebsdKinfoSize = 1088
+
+var freebsdKinfo = kinfoLayout{pid: 72, ppid: 76, uid: 168, comm: 447, commSize: 20}
+
+func getProcesses() ([]Process, error) {
+	if unsafe.Sizeof(uintptr(0)) != 8 {
+		return nil, unsupported("process listing is not supported on " + runtime.GOOS + "/" + runtime.GOARCH)
+	}
+
+	data, err := readKinfo("kern.proc.proc")
+	if err != nil {
+		return nil, err
+	}
+
+	var processes []Process
+	for offset := 0; offset + freebsdKinfoSize <= len(data); offset += freebsdKinfoSize {
+		record := data[offset : offset + freebsdKinfoSize]
+		if kinfoByteOrder.Uint32(record) != freebsdKinfoSize {
+			return nil, unsupported("unknown kinfo_proc layout")
+		}
+
+		process := freebsdKinfo.process(record)
+		seconds := kinfoByteOrder.Uint64(record[336:])
+		microseconds := kinfoByteOrder.Uint64(record[344:])
+		process.StartTime = time.Unix(int64(seconds), int64(microseconds) * 1000)
+
+		if args, err := unix.SysctlRaw("kern.proc.args", process.Pid); err == nil {
+			if command := parseArguments(args); command != "" {
+				process.Command = command
+			}
+		}
+
+		processes = append(processes, process)
+	}
+	return processes, nil
+}
@@ -0,0 +1,104 @@
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Kernel clock ticks per second used by /proc/<pid>/stat, 100 on every
+// architecture Go supports.
+const clockTicks = 100
+
+func getBootTime() time.Time {
+	content, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "btime" {
+			seconds, _ := strconv.ParseInt(fields[1], 10, 64)
+			return time.Unix(seconds, 0)
+		}
+	}
+	return time.Time{}
+}
+
+func getProcesses() ([]Process, error) {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	bootTime := getBootTime()
+
+	processes := make([]Process, 0, len(dirs))
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+
+		process, err := readProcess(pid, bootTime)
+		if err != nil {
+			continue
+		}
+		processes = append(processes, *process)
+	}
+	return processes, nil
+}
+
+func readProcess(pid int, bootTime time.Time) (*Process, error) {
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+
+	stat, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	// The command name is between parentheses and may contain spaces
+	start := bytes.IndexByte(stat, '(')
+	end := bytes.LastIndexByte(stat, ')')
+	if start < 0 || end < start {
+		return nil, os.ErrInvalid
+	}
+
+	name := string(stat[start+1 : end])
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return nil, os.ErrInvalid
+	}
+
+	process := Process{Pid: pid}
+	process.Ppid, _ = strconv.Atoi(fields[1])
+
+	ticks, _ := strconv.ParseInt(fields[19], 10, 64)
+	if !bootTime.IsZero() {
+		process.StartTime = bootTime.Add(time.Duration(ticks) * time.Second / clockTicks)
+	}
+
+	if info, err := os.Stat(dir); err == nil {
+		if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+			process.User = lookupUserNameById(sys.Uid)
+		}
+	}
+
+	cmdline, _ := ioutil.ReadFile(filepath.Join(dir, "cmdline"))
+	cmdline = bytes.TrimRight(cmdline, "\x00")
+	if len(cmdline) > 0 {
+		process.Command = string(bytes.Replace(cmdline, []byte{0}, []byte{' '}, -1))
+	} else {
+		process.Command = "[" + name + "]"
+	}
+
+	return &process, nil
+}
@@ -0,0 +1,44 @@
+// +build netbsd
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"time"
+)
+
+const (
+	kernProcAll  = 0
+	kernProcArgv = 1
+
+	// struct kinfo_proc2 up to p_ustart_usec
+	netbsdKinfoSize = 464
+)
+
+var netbsdKinfo = kinfoLayout{pid: 116, ppid: 120, uid: 136, comm: 368, commSize: 24}
+
+func getProcesses() ([]Process, error) {
+	data, err := readKinfo("kern.proc2", kernProcAll, 0, netbsdKinfoSize, 1 << 20)
+	if err != nil {
+		return nil, err
+	}
+
+	var processes []Process
+	for offset := 0; offset + netbsdKinfoSize <= len(data); offset += netbsdKinfoSize {
+		record := data[offset : offset + netbsdKinfoSize]
+
+		process := netbsdKinfo.process(record)
+		seconds := kinfoByteOrder.Uint32(record[456:])
+		microseconds := kinfoByteOrder.Uint32(record[460:])
+		process.StartTime = time.Unix(int64(seconds), int64(microseconds) * 1000)
+
+		if args, err := unix.SysctlRaw("kern.proc_args", process.Pid, kernProcArgv); err == nil {
+			if command := parseArguments(args); command != "" {
+				process.Command = command
+			}
+		}
+
+		processes = append(processes, process)
+	}
+	return processes, nil
+}
@@ -0,0 +1,38 @@
+// +build openbsd
+
+package main
+
+import (
+	"time"
+)
+
+const (
+	kernProcAll = 0
+
+	// struct kinfo_proc up to p_ustart_usec
+	openbsdKinfoSize = 420
+)
+
+var openbsdKinfo = kinfoLayout{pid: 108, ppid: 112, uid: 128, comm: 312, commSize: 24}
+
+// getProcesses reads kern.proc. The arguments sysctl isn't known by
+// golang.org/x/sys, commands are the process names.
+func getProcesses() ([]Process, error) {
+	data, err := readKinfo("kern.proc", kernProcAll, 0, openbsdKinfoSize, 1 << 20)
+	if err != nil {
+		return nil, err
+	}
+
+	var processes []Process
+	for offset := 0; offset + openbsdKinfoSize <= len(data); offset += openbsdKinfoSize {
+		record := data[offset : offset + openbsdKinfoSize]
+
+		process := openbsdKinfo.process(record)
+		seconds := kinfoByteOrder.Uint64(record[408:])
+		microseconds := kinfoByteOrder.Uint32(record[416:])
+		process.StartTime = time.Unix(int64(seconds), int64(microseconds) * 1000)
+
+		processes = append(processes, process)
+	}
+	return processes, nil
+}
@@ -0,0 +1,80 @@
+// +build windows
+
+package main
+
+import (
+	"golang.org/x/sys/windows"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func getProcesses() ([]Process, error) {
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer windows.CloseHandle(snapshot)
+
+	var entry windows.ProcessEntry32
+	entry.Size = uint32(unsafe.Sizeof(entry))
+
+	err = windows.Process32First(snapshot, &entry)
+	if err != nil {
+		return nil, err
+	}
+
+	var processes []Process
+	for err == nil {
+		process := Process{
+			Pid:     int(entry.ProcessID),
+			Ppid:    int(entry.ParentProcessID),
+			Command: syscall.UTF16ToString(entry.ExeFile[:]),
+		}
+		readProcessDetails(&process)
+		processes = append(processes, process)
+
+		err = windows.Process32Next(snapshot, &entry)
+	}
+	return processes, nil
+}
+
+// readProcessDetails adds what needs a process handle, it silently
+// fails for processes the agent is not allowed to open.
+func readProcessDetails(process *Process) {
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(process.Pid))
+	if err != nil {
+		return
+	}
+
+	defer windows.CloseHandle(handle)
+
+	buffer := make([]uint16, windows.MAX_PATH)
+	size := uint32(len(buffer))
+	if windows.QueryFullProcessImageName(handle, 0, &buffer[0], &size) == nil {
+		process.Command = syscall.UTF16ToString(buffer[:size])
+	}
+
+	var creation, exit, kernel, user windows.Filetime
+	if windows.GetProcessTimes(handle, &creation, &exit, &kernel, &user) == nil {
+		process.StartTime = time.Unix(0, creation.Nanoseconds())
+	}
+
+	var token windows.Token
+	if windows.OpenProcessToken(handle, windows.TOKEN_QUERY, &token) != nil {
+		return
+	}
+
+	defer token.Close()
+
+	tokenUser, err := token.GetTokenUser()
+	if err != nil {
+		return
+	}
+
+	account, domain, _, err := tokenUser.User.Sid.LookupAccount("")
+	if err == nil {
+		process.User = domain + "\\" + account
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/xtaci/smux"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Frames are a 4 bytes big endian length followed by a JSON message,
+// see gomet/Protocol.go for the controller side.
+const protocolVersion = 1
+
+const maxFrameSize = 16 * 1024 * 1024
+
+const (
+	statusOk          = "ok"
+	statusError       = "error"
+	statusUnsupported = "unsupported"
+)
+
+// unsupported is returned by the handlers missing on the agent OS, the
+// controller falls back to its commands.
+type unsupported string
+
+func (u unsupported) Error() string {
+	return string(u)
+}
+
+type Message struct {
+	Id          uint32             `json:"id"`
+	Type        string             `json:"type,omitempty"`
+	Status      string             `json:"status,omitempty"`
+	Error       string             `json:"error,omitempty"`
+	Streams     int                `json:"streams,omitempty"`
+	Compression string             `json:"compression,omitempty"`
+	Cwd         string             `json:"cwd,omitempty"`
+	Env         map[string]*string `json:"env,omitempty"`
+	Data        json.RawMessage    `json:"data,omitempty"`
+}
+
+type SystemInfo struct {
+	Version        int            `json:"version"`
+	AgentVersion   string         `json:"agentVersion,omitempty"`
+	AgentId        string         `json:"agentId,omitempty"`
+	BuildId        string         `json:"buildId,omitempty"`
+	Os             string         `json:"os,omitempty"`
+	Arch           string         `json:"arch,omitempty"`
+	Hostname       string         `json:"hostname,omitempty"`
+	Pid            int            `json:"pid,omitempty"`
+	User           string         `json:"user,omitempty"`
+	Uid            string         `json:"uid,omitempty"`
+	Gid            string         `json:"gid,omitempty"`
+	Cwd            string         `json:"cwd,omitempty"`
+	Interfaces     []NetInterface `json:"interfaces,omitempty"`
+	Compressions   []string       `json:"compressions,omitempty"`
+	KillDate       *time.Time     `json:"killDate,omitempty"`
+	OperatingHours string         `json:"operatingHours,omitempty"`
+}
+
+type NetInterface struct {
+	Name         string   `json:"name"`
+	HardwareAddr string   `json:"hardwareAddr,omitempty"`
+	Addresses    []string `json:"addresses"`
+}
+
+// Timeout is in seconds, 0 for none.
+type CommandParams struct {
+	Command string `json:"command"`
+	Timeout int    `json:"timeout,omitempty"`
+}
+
+type ExecuteResult struct {
+	ExitCode int  `json:"exitCode"`
+	Canceled bool `json:"canceled,omitempty"`
+	TimedOut bool `json:"timedOut,omitempty"`
+}
+
+type ShellParams struct {
+	Name string `json:"name,omitempty"`
+	Term string `json:"term,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
+}
+
+type ShellResult struct {
+	Exited   bool `json:"exited"`
+	ExitCode int  `json:"exitCode"`
+}
+
+type ShellInfo struct {
+	Name      string    `json:"name"`
+	Pid       int       `json:"pid"`
+	Attached  bool      `json:"attached"`
+	StartTime time.Time `json:"startTime"`
+}
+
+// WindowSize is sent in "resize" frames on the control stream of a shell.
+type WindowSize struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+type FileParams struct {
+	Path      string `json:"path"`
+	Recursive bool   `json:"recursive,omitempty"`
+}
+
+type TransferParams struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+type TransferInfo struct {
+	Size   int64 `json:"size"`
+	Offset int64 `json:"offset"`
+}
+
+type TransferResult struct {
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+type ArchiveParams struct {
+	Path        string   `json:"path"`
+	Compression string   `json:"compression,omitempty"`
+	Include     []string `json:"include,omitempty"`
+	Exclude     []string `json:"exclude,omitempty"`
+}
+
+type ArchiveResult struct {
+	Files int   `json:"files"`
+	Size  int64 `json:"size"`
+}
+
+type FileEntry struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	IsDir   bool      `json:"isDir"`
+	ModTime time.Time `json:"modTime"`
+	Owner   string    `json:"owner,omitempty"`
+	Group   string    `json:"group,omitempty"`
+}
+
+type MoveParams struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+type ChmodParams struct {
+	Path string `json:"path"`
+	Mode uint32 `json:"mode"`
+}
+
+type Process struct {
+	Pid       int       `json:"pid"`
+	Ppid      int       `json:"ppid"`
+	User      string    `json:"user"`
+	Command   string    `json:"command"`
+	StartTime time.Time `json:"startTime"`
+}
+
+type ProcessParams struct {
+	Pid int `json:"pid"`
+}
+
+type Connection struct {
+	Protocol      string `json:"protocol"`
+	Type          string `json:"type,omitempty"`
+	LocalAddress  string `json:"localAddress"`
+	RemoteAddress string `json:"remoteAddress,omitempty"`
+	State         string `json:"state,omitempty"`
+	User          string `json:"user,omitempty"`
+	Inode         string `json:"inode,omitempty"`
+	Pid           int    `json:"pid,omitempty"`
+}
+
+type AddressParams struct {
+	Address string `json:"address"`
+}
+
+type CancelParams struct {
+	Id uint32 `json:"id"`
+}
+
+// Delay is in seconds before the agent reconnects, 0 for its reconnect interval.
+type LifecycleParams struct {
+	Delay int `json:"delay,omitempty"`
+}
+
+type LifecycleResult struct {
+	Pid        int      `json:"pid"`
+	Executable string   `json:"executable,omitempty"`
+	Removed    []string `json:"removed,omitempty"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+func writeFrame(writer io.Writer, message *Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	_, err = writer.Write(frame)
+	return err
+}
+
+func readFrame(reader io.Reader) (*Message, error) {
+	var header [4]byte
+	_, err := io.ReadFull(reader, header[:])
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return nil, errors.New("frame too large")
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var message Message
+	err = json.Unmarshal(data, &message)
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// Transfers send data in chunks, each one is a 4 bytes big endian length
+// followed by the data. An empty chunk marks the end of the data.
+const chunkSize = 32 * 1024
+
+type chunkWriter struct {
+	writer io.Writer
+}
+
+func (c *chunkWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		size := len(data)
+		if size > chunkSize {
+			size = chunkSize
+		}
+
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], uint32(size))
+		_, err := c.writer.Write(header[:])
+		if err != nil {
+			return written, err
+		}
+
+		_, err = c.writer.Write(data[:size])
+		if err != nil {
+			return written, err
+		}
+
+		written += size
+		data = data[size:]
+	}
+	return written, nil
+}
+
+type flusher interface {
+	Flush() error
+}
+
+// Close writes the last chunk and flushes the writer if it buffers.
+func (c *chunkWriter) Close() error {
+	var header [4]byte
+	_, err := c.writer.Write(header[:])
+	if err != nil {
+		return err
+	}
+	if f, ok := c.writer.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+type chunkReader struct {
+	reader io.Reader
+	remaining uint32
+	done bool
+}
+
+func (c *chunkReader) Read(data []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+
+	if c.remaining == 0 {
+		var header [4]byte
+		_, err := io.ReadFull(c.reader, header[:])
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		c.remaining = binary.BigEndian.Uint32(header[:])
+		if c.remaining == 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+		if c.remaining > chunkSize {
+			return 0, errors.New("chunk too large")
+		}
+	}
+
+	if uint32(len(data)) > c.remaining {
+		data = data[:c.remaining]
+	}
+
+	n, err := c.reader.Read(data)
+	c.remaining -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+/* ------------------
+  Request
+ -------------------- */
+
+type Request struct {
+	*Message
+	agent   *Agent
+	streams int32
+
+	// afterReply is called once the reply is sent
+	afterReply func()
+}
+
+func (r *Request) Params(value interface{}) error {
+	if len(r.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Data, value)
+}
+
+// OpenStream opens a new stream tagged with the request Id so the
+// controller can hand it to the command waiting for it.
+func (r *Request) OpenStream() (*smux.Stream, error) {
+	return r.OpenNamedStream("")
+}
+
+// OpenNamedStream is OpenStream for requests using several streams,
+// the name tells the controller which one it is.
+func (r *Request) OpenNamedStream(name string) (*smux.Stream, error) {
+	stream, err := r.agent.session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFrame(stream, &Message{Id: r.Id, Type: name})
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	atomic.AddInt32(&r.streams, 1)
+	return stream, nil
+}
+
+// OpenDataStream is OpenNamedStream compressed as asked by the controller.
+func (r *Request) OpenDataStream(name string) (io.ReadWriteCloser, error) {
+	stream, err := r.OpenNamedStream(name)
+	if err != nil {
+		return nil, err
+	}
+	return newDataStream(stream, r.Compression, isInteractiveStream(r.Type)), nil
+}
+
+// path resolves a relative path against the working directory of the session.
+func (r *Request) path(path string) string {
+	if path == "" || r.Cwd == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(r.Cwd, path)
+}
+
+// environ applies the environment of the session to base, a nil value unsets the variable.
+func (r *Request) environ(base []string) []string {
+	if len(r.Env) == 0 {
+		return base
+	}
+
+	env := make([]string, 0, len(base)+len(r.Env))
+	for _, variable := range base {
+		name := strings.SplitN(variable, "=", 2)[0]
+		if _, ok := r.Env[name]; !ok {
+			env = append(env, variable)
+		}
+	}
+
+	for name, value := range r.Env {
+		if value != nil {
+			env = append(env, name+"="+*value)
+		}
+	}
+	return env
+}
+
+func (r *Request) OnCancel(cancel func()) {
+	r.agent.cancelsLock.Lock()
+	r.agent.cancels[r.Id] = cancel
+	r.agent.cancelsLock.Unlock()
+}
+
+func (r *Request) reply(result interface{}, err error) *Message {
+	reply := Message{
+		Id:      r.Id,
+		Status:  statusOk,
+		Streams: int(atomic.LoadInt32(&r.streams)),
+	}
+
+	if _, ok := err.(unsupported); ok {
+		reply.Status = statusUnsupported
+		reply.Error = err.Error()
+	} else if err != nil {
+		reply.Status = statusError
+		reply.Error = err.Error()
+	} else if result != nil {
+		reply.Data, err = json.Marshal(result)
+		if err != nil {
+			reply.Status = statusError
+			reply.Error = err.Error()
+		}
+	}
+	return &reply
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Comma separated lists compiled from the scope of the controller, see gomet/Scope.go
+	scopeCidrs string
+	scopeHosts string
+	scopePorts string
+)
+
+// scope refuses the connect and listen targets out of the engagement, an
+// empty list allows everything.
+type scope struct {
+	networks []*net.IPNet
+	hosts []string
+	ports [][2]int
+}
+
+// agentScope is set once the settings are loaded
+var agentScope *scope
+
+func newScope() *scope {
+	s := &scope{}
+
+	for _, cidr := range splitList(scopeCidrs) {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil {
+			s.networks = append(s.networks, network)
+		}
+	}
+
+	for _, host := range splitList(scopeHosts) {
+		s.hosts = append(s.hosts, strings.ToLower(host))
+	}
+
+	for _, value := range splitList(scopePorts) {
+		bounds := strings.SplitN(value, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		last := first
+		if err == nil && len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+		}
+		if err == nil {
+			s.ports = append(s.ports, [2]int{first, last})
+		}
+	}
+	return s
+}
+
+func splitList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// checkAddress allows a host:port target. Names aren't resolved, they have to be listed.
+func (s *scope) checkAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	err = s.checkHost(host)
+	if err != nil {
+		return err
+	}
+	return s.checkPort(port)
+}
+
+// checkListen allows a listener, its address has to be in scope unless it listens on all of them.
+func (s *scope) checkListen(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		err = s.checkHost(host)
+		if err != nil {
+			return err
+		}
+	}
+	return s.checkPort(port)
+}
+
+func (s *scope) checkHost(host string) error {
+	if len(s.networks) == 0 && len(s.hosts) == 0 {
+		return nil
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range s.hosts {
+		if host == allowed {
+			return nil
+		}
+		if strings.HasPrefix(allowed, "*.") && (host == allowed[2:] || strings.HasSuffix(host, allowed[1:])) {
+			return nil
+		}
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range s.networks {
+			if network.Contains(ip) {
+				return nil
+			}
+		}
+	}
+	return errors.New("host " + host + " is out of scope")
+}
+
+func (s *scope) checkPort(port string) error {
+	if len(s.ports) == 0 {
+		return nil
+	}
+
+	number, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+
+	for _, bounds := range s.ports {
+		if number >= bounds[0] && number <= bounds[1] {
+			return nil
+		}
+	}
+	return errors.New("port " + port + " is out of scope")
+}
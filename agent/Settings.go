@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+const (
+	settingsMarkerSize = 32
+	settingsSize       = 16384
+)
+
+// settingsBlob is reserved in the agent templates, the controller finds it
+// by its marker and patches the settings of each build into it: the length
+// of the JSON settings on 4 bytes, big endian, then the settings. The marker
+// is only spelled here so it appears once in the binary. An agent built
+// with ldflags keeps an empty blob.
+var settingsBlob = [settingsSize]byte{
+	'G', 'o', 'M', 'e', 't', 'A', 'g', 'e', 'n', 't', 'S', 'e', 't', 't', 'i', 'n',
+	'g', 's', ':', '9', 'c', '4', '1', 'e', '0', '7', 'a', '2', 'f', '5', 'd', 'b',
+}
+
+// settings are the variables patched by the controller, by name.
+var settings = map[string]*string{
+	"connectHost":          &connectHost,
+	"httpProxyHost":        &httpProxyHost,
+	"httpsProxyHost":       &httpsProxyHost,
+	"proxyUsername":        &proxyUsername,
+	"proxyPassword":        &proxyPassword,
+	"pubKeySums":           &pubKeySums,
+	"buildId":              &buildId,
+	"buildSecret":          &buildSecret,
+	"clientCert":           &clientCert,
+	"clientKey":            &clientKey,
+	"reconnectInterval":    &reconnectInterval,
+	"reconnectMaxInterval": &reconnectMaxInterval,
+	"reconnectMaxRetries":  &reconnectMaxRetries,
+	"keepaliveInterval":    &keepaliveInterval,
+	"keepaliveTimeout":     &keepaliveTimeout,
+	"killDate":             &killDate,
+	"operatingHours":       &operatingHours,
+	"scopeCidrs":           &scopeCidrs,
+	"scopeHosts":           &scopeHosts,
+	"scopePorts":           &scopePorts,
+}
+
+// loadSettings sets the variables from the patched blob, if any.
+func loadSettings() error {
+	blob := settingsBlob[settingsMarkerSize:]
+	length := binary.BigEndian.Uint32(blob)
+	if length == 0 {
+		return nil
+	}
+	if int(length) > len(blob) - 4 {
+		return errors.New("invalid settings length")
+	}
+
+	var values map[string]string
+	err := json.Unmarshal(blob[4:4 + length], &values)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range values {
+		if variable, ok := settings[name]; ok {
+			*variable = value
+		}
+	}
+	return nil
+}
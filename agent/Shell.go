@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Named shells keep running when the controller detaches and outlive the
+// connection. The last scrollbackSize bytes of their output are replayed
+// when the controller attaches again.
+const scrollbackSize = 64 * 1024
+
+var shells = struct {
+	sync.Mutex
+	byName map[string]*persistentShell
+}{byName: make(map[string]*persistentShell)}
+
+// shellProcess is the platform dependent part of a shell, see startShell.
+type shellProcess struct {
+	command *exec.Cmd
+	input   io.Writer
+	output  io.Reader
+	resize  func(size WindowSize)
+	wait    func() error
+	close   func()
+}
+
+type persistentShell struct {
+	name      string
+	process   *shellProcess
+	startTime time.Time
+	done      chan struct{}
+	exitCode  int
+
+	lock       sync.Mutex
+	scrollback []byte
+	attached   io.WriteCloser
+}
+
+func newPersistentShell(name string, params ShellParams, request *Request) (*persistentShell, error) {
+	if params.Term == "" {
+		params.Term = "xterm"
+	}
+
+	process, err := startShell(params, request)
+	if err != nil {
+		return nil, err
+	}
+
+	shell := &persistentShell{
+		name:      name,
+		process:   process,
+		startTime: time.Now(),
+		done:      make(chan struct{}),
+	}
+
+	go shell.run()
+	return shell, nil
+}
+
+// run keeps the output of the shell until it exits.
+func (s *persistentShell) run() {
+	var err error
+	exited := make(chan struct{})
+	go func() {
+		err = s.process.wait()
+		close(exited)
+	}()
+
+	buffer := make([]byte, 32*1024)
+	for {
+		n, readErr := s.process.output.Read(buffer)
+		if n > 0 {
+			s.write(buffer[:n])
+		}
+		if readErr != nil {
+			break
+		}
+	}
+
+	<-exited
+	s.process.close()
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		s.exitCode = exitErr.ExitCode()
+	}
+
+	shells.Lock()
+	if shells.byName[s.name] == s {
+		delete(shells.byName, s.name)
+	}
+	shells.Unlock()
+
+	close(s.done)
+
+	s.lock.Lock()
+	if s.attached != nil {
+		s.attached.Close()
+		s.attached = nil
+	}
+	s.lock.Unlock()
+}
+
+func (s *persistentShell) write(data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.scrollback = append(s.scrollback, data...)
+	if len(s.scrollback) > scrollbackSize {
+		s.scrollback = append([]byte(nil), s.scrollback[len(s.scrollback)-scrollbackSize:]...)
+	}
+
+	if s.attached != nil {
+		_, err := s.attached.Write(data)
+		if err != nil {
+			s.attached = nil
+		}
+	}
+}
+
+// attach replays the scrollback to stream then sends it the output,
+// a shell is attached to one stream at a time.
+func (s *persistentShell) attach(stream io.WriteCloser) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.attached != nil {
+		s.attached.Close()
+	}
+
+	_, err := stream.Write(s.scrollback)
+	if err != nil {
+		return err
+	}
+
+	s.attached = stream
+	return nil
+}
+
+func (s *persistentShell) detach(stream io.WriteCloser) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.attached == stream {
+		s.attached = nil
+	}
+}
+
+func (s *persistentShell) kill() {
+	s.process.command.Process.Kill()
+}
+
+func (s *persistentShell) info() ShellInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return ShellInfo{
+		Name:      s.name,
+		Pid:       s.process.command.Process.Pid,
+		Attached:  s.attached != nil,
+		StartTime: s.startTime,
+	}
+}
+
+func (s *persistentShell) exited() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// getShell returns the named shell, started the first time in the working
+// directory of the request. Shells without a name are not registered and
+// are killed when the controller detaches.
+func getShell(params ShellParams, request *Request) (*persistentShell, error) {
+	if params.Name == "" {
+		return newPersistentShell("", params, request)
+	}
+
+	shells.Lock()
+	defer shells.Unlock()
+
+	if shell, ok := shells.byName[params.Name]; ok {
+		return shell, nil
+	}
+
+	shell, err := newPersistentShell(params.Name, params, request)
+	if err != nil {
+		return nil, err
+	}
+	shells.byName[params.Name] = shell
+	return shell, nil
+}
+
+func (a *Agent) shell(request *Request) (interface{}, error) {
+
+	var params ShellParams
+	err := request.Params(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	shell, err := getShell(params, request)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Name == "" {
+		defer func() {
+			shell.kill()
+			<-shell.done
+		}()
+	}
+
+	control, err := request.OpenNamedStream("control")
+	if err != nil {
+		return nil, err
+	}
+
+	defer control.Close()
+
+	stream, err := request.OpenDataStream("")
+	if err != nil {
+		return nil, err
+	}
+
+	defer stream.Close()
+
+	go resizeShell(control, shell.process.resize)
+
+	err = shell.attach(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	detached := make(chan struct{})
+	go func() {
+		io.Copy(shell.process.input, stream)
+		close(detached)
+	}()
+
+	select {
+	case <-shell.done:
+	case <-detached:
+		shell.detach(stream)
+	}
+
+	if params.Name != "" && !shell.exited() {
+		return &ShellResult{}, nil
+	}
+
+	if params.Name == "" {
+		shell.kill()
+	}
+	<-shell.done
+	return &ShellResult{Exited: true, ExitCode: shell.exitCode}, nil
+}
+
+// resizeShell applies the window sizes sent by the controller.
+func resizeShell(control io.Reader, resize func(size WindowSize)) {
+	for {
+		message, err := readFrame(control)
+		if err != nil {
+			return
+		}
+
+		if message.Type != "resize" {
+			continue
+		}
+
+		var size WindowSize
+		err = json.Unmarshal(message.Data, &size)
+		if err != nil {
+			continue
+		}
+
+		resize(size)
+	}
+}
+
+func (a *Agent) listShells(request *Request) (interface{}, error) {
+	shells.Lock()
+	defer shells.Unlock()
+
+	list := make([]ShellInfo, 0, len(shells.byName))
+	for _, shell := range shells.byName {
+		list = append(list, shell.info())
+	}
+	return list, nil
+}
+
+func (a *Agent) killShell(request *Request) (interface{}, error) {
+	var params ShellParams
+	err := request.Params(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	shells.Lock()
+	shell, ok := shells.byName[params.Name]
+	shells.Unlock()
+
+	if !ok {
+		return nil, errors.New("no shell named " + params.Name)
+	}
+
+	shell.kill()
+	<-shell.done
+	return nil, nil
+}
@@ -4,50 +4,40 @@ package main
 
 import (
 	"github.com/kr/pty"
-	"io"
 	"os/exec"
 	"syscall"
 )
 
 
-func (a *Agent) execute(command string) {
-
-	stream := openNewStream(a.session)
-
-	if  stream == nil {
-		return
-	}
-
-	defer stream.Close()
-
+// shellCommand runs in its own process group so killCommand stops its children too.
+func shellCommand(command string) *exec.Cmd {
 	cmd := exec.Command("sh", "-c", command)
-	cmd.Stdout = stream
-	cmd.Stderr = stream
-
-	cmd.Run()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
 }
 
+func killCommand(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
 
-func (a *Agent) shell() {
-
-	stream := openNewStream(a.session)
-
-	if stream == nil {
-		return
-	}
 
-	defer stream.Close()
+func startShell(params ShellParams, request *Request) (*shellProcess, error) {
 
 	file, tty, err := pty.Open()
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	defer file.Close()
+	// The pty only reports the end of the shell once every tty is closed
 	defer tty.Close()
 
+	if params.Rows > 0 && params.Cols > 0 {
+		pty.Setsize(file, &pty.Winsize{Rows: params.Rows, Cols: params.Cols})
+	}
+
 	command := exec.Command("bash")
-	command.Env = []string{"TERM=xterm"}
+	command.Dir = request.Cwd
+	command.Env = request.environ([]string{"TERM=" + params.Term})
 	command.Stdout = tty
 	command.Stdin = tty
 	command.Stderr = tty
@@ -58,16 +48,20 @@ func (a *Agent) shell() {
 
 	err = command.Start()
 	if err != nil {
-		return
+		file.Close()
+		return nil, err
 	}
 
-	go func() {
-		io.Copy(stream, file)
-	}()
-
-	go func() {
-		io.Copy(file, stream)
-	}()
-
-	command.Wait()
-}
\ No newline at end of file
+	return &shellProcess{
+		command: command,
+		input:   file,
+		output:  file,
+		resize: func(size WindowSize) {
+			pty.Setsize(file, &pty.Winsize{Rows: size.Rows, Cols: size.Cols})
+		},
+		wait: command.Wait,
+		close: func() {
+			file.Close()
+		},
+	}, nil
+}
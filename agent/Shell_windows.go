@@ -3,38 +3,36 @@
 package main
 
 import (
+	"io"
 	"os"
 	"os/exec"
+	"strconv"
 	"syscall"
 )
 
-func (a *Agent) execute(command string) {
-
-	stream := openNewStream(a.session)
-
-	if  stream == nil {
-		return
-	}
-
-	defer stream.Close()
-
+func shellCommand(command string) *exec.Cmd {
 	cmd := exec.Command("cmd.exe", "/C", command)
-	cmd.Stdout = stream
-	cmd.Stderr = stream
-
-	cmd.Run()
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
+		HideWindow: true,
+	}
+	return cmd
 }
 
-
-func (a *Agent) shell() {
-
-	stream := openNewStream(a.session)
-
-	if stream == nil {
-		return
+// killCommand kills the process tree of the command.
+func killCommand(cmd *exec.Cmd) error {
+	kill := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid))
+	kill.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	err := kill.Run()
+	if err != nil {
+		return cmd.Process.Kill()
 	}
+	return nil
+}
+
 
-	defer stream.Close()
+// Without a console there is no window size, resizes are ignored.
+func startShell(params ShellParams, request *Request) (*shellProcess, error) {
 
 	var shell string
 	shell = os.Getenv("SHELL")
@@ -42,19 +40,39 @@ func (a *Agent) shell() {
 		shell = "cmd.exe"
 	}
 
+	reader, writer := io.Pipe()
+
 	command := exec.Command(shell)
-	command.Env = []string{}
-	command.Stdout = stream
-	command.Stdin = stream
-	command.Stderr = stream
+	command.Dir = request.Cwd
+	command.Env = request.environ([]string{})
+	command.Stdout = writer
+	command.Stderr = writer
 	command.SysProcAttr = &syscall.SysProcAttr{
 		HideWindow: true,
 	}
 
-	err := command.Start()
+	input, err := command.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = command.Start()
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	command.Wait()
+	return &shellProcess{
+		command: command,
+		input:   input,
+		output:  reader,
+		resize:  func(size WindowSize) {},
+		wait: func() error {
+			err := command.Wait()
+			writer.Close()
+			return err
+		},
+		close: func() {
+			input.Close()
+		},
+	}, nil
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const agentVersion = "1.0.0"
+
+var machineIdFiles = []string{
+	"/etc/machine-id",
+	"/var/lib/dbus/machine-id",
+	"/etc/hostid",
+}
+
+func getSystemInfo() *SystemInfo {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	info := SystemInfo{
+		Version:      protocolVersion,
+		AgentVersion: agentVersion,
+		AgentId:      getAgentId(hostname),
+		BuildId:      buildId,
+		Os:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		Hostname:     hostname,
+		Pid:          os.Getpid(),
+		Interfaces:   getInterfaces(),
+		Compressions: supportedCompressions,
+	}
+
+	limits := newLimits()
+	if !limits.killDate.IsZero() {
+		info.KillDate = &limits.killDate
+	}
+	if limits.hours {
+		info.OperatingHours = operatingHours
+	}
+
+	if current, err := user.Current(); err == nil {
+		info.User = current.Username
+		info.Uid = current.Uid
+		info.Gid = current.Gid
+	}
+
+	if cwd, err := os.Getwd(); err == nil {
+		info.Cwd = cwd
+	}
+
+	return &info
+}
+
+var agentId struct {
+	sync.Once
+	id string
+}
+
+// getAgentIdFileName returns the file keeping the Id, next to the lockfile.
+func getAgentIdFileName() string {
+	return filepath.Join(os.TempDir(), getLockfileName() + ".id")
+}
+
+// getAgentId returns an Id stable across restarts of the agent on the same
+// host. It is random, saved with a sum of the machine-id and hostname, and
+// generated again when the file is missing or the sum differs. Clones which
+// keep the file, the machine-id and the hostname share the Id.
+func getAgentId(hostname string) string {
+	agentId.Do(func() {
+		machineId := hostname
+		for _, filename := range machineIdFiles {
+			content, err := ioutil.ReadFile(filename)
+			if err == nil && len(strings.TrimSpace(string(content))) > 0 {
+				machineId = strings.TrimSpace(string(content))
+				break
+			}
+		}
+		machineSum := getHexSumFromString(machineId + hostname)[:16]
+
+		filename := getAgentIdFileName()
+		content, err := ioutil.ReadFile(filename)
+		if fields := strings.Fields(string(content)); err == nil && len(fields) == 2 && fields[1] == machineSum {
+			agentId.id = fields[0]
+			return
+		}
+
+		random := make([]byte, 8)
+		_, err = rand.Read(random)
+		if err != nil {
+			agentId.id = machineSum
+			return
+		}
+
+		agentId.id = hex.EncodeToString(random)
+		ioutil.WriteFile(filename, []byte(agentId.id + " " + machineSum + "\n"), 0600)
+	})
+	return agentId.id
+}
+
+func getInterfaces() []NetInterface {
+	var result []NetInterface
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return result
+	}
+
+	for _, iface := range interfaces {
+		netInterface := NetInterface{
+			Name:         iface.Name,
+			HardwareAddr: iface.HardwareAddr.String(),
+			Addresses:    []string{},
+		}
+
+		addrs, err := iface.Addrs()
+		if err == nil {
+			for _, addr := range addrs {
+				netInterface.Addresses = append(netInterface.Addresses, addr.String())
+			}
+		}
+
+		result = append(result, netInterface)
+	}
+	return result
+}
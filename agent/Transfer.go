@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"os"
+)
+
+// hashPrefix feeds the first size bytes of file to hash, so a resumed
+// transfer is verified against the whole file.
+func hashPrefix(file *os.File, size int64, hash hash.Hash) error {
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(hash, file, size)
+	return err
+}
+
+func (a *Agent) download(request *Request) (interface{}, error) {
+	var params TransferParams
+	err := request.Params(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	params.Path = request.path(params.Path)
+
+	file, err := os.Open(params.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return nil, errors.New(params.Path + " is a directory")
+	}
+
+	if params.Offset > info.Size() {
+		return nil, errors.New("offset beyond end of file")
+	}
+
+	sum := sha256.New()
+	err = hashPrefix(file, params.Offset, sum)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := request.OpenDataStream("")
+	if err != nil {
+		return nil, err
+	}
+
+	defer stream.Close()
+
+	data, _ := json.Marshal(TransferInfo{Size: info.Size(), Offset: params.Offset})
+	err = writeFrame(stream, &Message{Id: request.Id, Data: data})
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := &chunkWriter{writer: stream}
+
+	size, err := io.Copy(io.MultiWriter(chunks, sum), file)
+	if err != nil {
+		return nil, err
+	}
+
+	err = chunks.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return &TransferResult{
+		Size:   params.Offset + size,
+		Sha256: hex.EncodeToString(sum.Sum(nil)),
+	}, nil
+}
+
+// upload writes into <path>.part, which is kept when the transfer is
+// interrupted so it can be resumed, and renamed once the hash is verified.
+// A part shorter than the offset is removed so the upload restarts from 0.
+func (a *Agent) upload(request *Request) (interface{}, error) {
+	var params TransferParams
+	err := request.Params(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	params.Path = request.path(params.Path)
+
+	partFilename := params.Path + ".part"
+
+	file, err := os.OpenFile(partFilename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if params.Offset > info.Size() {
+		file.Close()
+		os.Remove(partFilename)
+		return nil, errors.New("offset beyond end of partial file, restart from 0")
+	}
+
+	err = file.Truncate(params.Offset)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	sum := sha256.New()
+	err = hashPrefix(file, params.Offset, sum)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	stream, err := request.OpenDataStream("")
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	defer stream.Close()
+
+	size, err := io.Copy(io.MultiWriter(file, sum), &chunkReader{reader: stream})
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	result := TransferResult{
+		Size:   params.Offset + size,
+		Sha256: hex.EncodeToString(sum.Sum(nil)),
+	}
+
+	if result.Size != params.Size || result.Sha256 != params.Sha256 {
+		os.Remove(partFilename)
+		return nil, errors.New("integrity check failed")
+	}
+
+	err = os.Rename(partFilename, params.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (a *Agent) downloadArchive(request *Request) (interface{}, error) {
+	var params ArchiveParams
+	err := request.Params(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	params.Path = request.path(params.Path)
+
+	_, err = os.Stat(params.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := request.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+
+	defer stream.Close()
+
+	writer, err := newCompressWriter(stream, params.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := writeArchive(writer, params.Path, params.Include, params.Exclude)
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+	return result, writer.Close()
+}
+
+func (a *Agent) uploadArchive(request *Request) (interface{}, error) {
+	var params ArchiveParams
+	err := request.Params(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	params.Path = request.path(params.Path)
+
+	stream, err := request.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+
+	defer stream.Close()
+
+	reader, err := newDecompressReader(stream, params.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	return extractArchive(reader, params.Path)
+}
@@ -0,0 +1,28 @@
+#!/bin/sh
+# Builds the agent templates patched by the controller, for the targets given
+# as os/arch arguments or the common ones. Only this script needs Go, GoMet
+# builds in GOPATH mode.
+#
+# darwin/arm64 isn't built by default: patching the settings invalidates the
+# ad-hoc signature, macOS kills the agent until it is signed again with
+# "codesign -s -".
+set -e
+
+TARGETS="$*"
+if [ -z "$TARGETS" ]; then
+	TARGETS="linux/amd64 linux/386 linux/arm linux/arm64 darwin/amd64 windows/amd64 windows/386 freebsd/amd64"
+fi
+
+mkdir -p templates
+
+for target in $TARGETS; do
+	os=${target%/*}
+	arch=${target#*/}
+	output="templates/agent_${os}_${arch}"
+	if [ "$os" = "windows" ]; then
+		output="$output.exe"
+	fi
+
+	echo "Building $output"
+	GO111MODULE=off GOOS=$os GOARCH=$arch CGO_ENABLED=0 go build -trimpath -ldflags "-s -w" -o "$output" ./agent
+done
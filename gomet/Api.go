@@ -1,11 +1,14 @@
 package gomet
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"github.com/gorilla/mux"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 
@@ -13,6 +16,43 @@ type Api struct {
 	server *Server
 }
 
+type FileOperation struct {
+	Path        string `json:"path"`
+	Destination string `json:"destination,omitempty"`
+	Mode        string `json:"mode,omitempty"`
+	Recursive   bool   `json:"recursive,omitempty"`
+}
+
+type TransferRequest struct {
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Compression string   `json:"compression,omitempty"`
+	Include     []string `json:"include,omitempty"`
+	Exclude     []string `json:"exclude,omitempty"`
+}
+
+type CompressionSetting struct {
+	Algorithm string   `json:"algorithm"`
+	Streams   []string `json:"streams,omitempty"`
+}
+
+type PingResult struct {
+	Latency  float64   `json:"latency"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+type ApiError struct {
+	Error string `json:"error"`
+}
+
+type CommandOutput struct {
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	ExitCode int    `json:"exitCode"`
+	Error    string `json:"error,omitempty"`
+}
+
 func NewApi(server *Server) *Api {
 
 	return &Api{
@@ -23,20 +63,60 @@ func NewApi(server *Server) *Api {
 func (s *Api) Start() {
 	router := mux.NewRouter()
 
+	router.HandleFunc("/builds", s.GetBuilds).Methods("GET")
+	router.HandleFunc("/builds/{Id}", s.GetBuild).Methods("GET")
+	router.HandleFunc("/builds/{Id}/revoke", s.RevokeBuild).Methods("POST")
 	router.HandleFunc("/sessions", s.GetSessions).Methods("GET")
 	router.HandleFunc("/sessions/{Id}", s.GetSession).Methods("GET")
 	router.HandleFunc("/sessions/{Id}", s.CloseSession).Methods("DELETE")
+	router.HandleFunc("/sessions/{Id}/files", s.ListFiles).Methods("GET")
+	router.HandleFunc("/sessions/{Id}/files/stat", s.StatFile).Methods("GET")
+	router.HandleFunc("/sessions/{Id}/files/{Operation}", s.FileOperation).Methods("POST")
+	router.HandleFunc("/sessions/{Id}/processes", s.ListProcesses).Methods("GET")
+	router.HandleFunc("/sessions/{Id}/processes/{Pid}", s.KillProcess).Methods("DELETE")
+	router.HandleFunc("/sessions/{Id}/connections", s.ListConnections).Methods("GET")
+	router.HandleFunc("/sessions/{Id}/interfaces", s.ListInterfaces).Methods("GET")
+	router.HandleFunc("/sessions/{Id}/routes", s.AddSessionRoutes).Methods("POST")
+	router.HandleFunc("/sessions/{Id}/compression", s.GetCompression).Methods("GET")
+	router.HandleFunc("/sessions/{Id}/ping", s.Ping).Methods("GET")
+	router.HandleFunc("/sessions/{Id}/notes", s.ListNotes).Methods("GET")
+	router.HandleFunc("/sessions/{Id}/notes", s.AddNote).Methods("POST")
+	router.HandleFunc("/sessions/{Id}/{Action:disconnect|terminate|uninstall}", s.Lifecycle).Methods("POST")
+	router.HandleFunc("/sessions/{Id}/transfers", s.ListTransfers).Methods("GET")
+	router.HandleFunc("/sessions/{Id}/shells", s.ListShells).Methods("GET")
+	router.HandleFunc("/sessions/{Id}/shells/{Name}", s.KillShell).Methods("DELETE")
+	router.HandleFunc("/sessions/{Id}/transfers", s.StartTransfer).Methods("POST")
+	router.HandleFunc("/sessions/{Id}/transfers/{TransferId}", s.GetTransfer).Methods("GET")
+	router.HandleFunc("/sessions/{Id}/compression", s.SetCompression).Methods("POST")
 	router.HandleFunc("/sessions/{Id}/{Command}", s.GetSessionCommand).Methods("GET")
 
 	log.Fatal(http.ListenAndServe(s.server.config.Api.Addr, router))
 }
 
-func (s *Api) GetSessions(w http.ResponseWriter, r *http.Request) {
-	sessions := make([]Session, 0)
-	for _, session := range s.server.sessions {
-		sessions = append(sessions, *session)
+func (s *Api) GetBuilds(w http.ResponseWriter, r *http.Request) {
+	sendJson(w, s.server.Builds())
+}
+
+func (s *Api) GetBuild(w http.ResponseWriter, r *http.Request) {
+	build, err := s.server.Build(mux.Vars(r)["Id"])
+	if err != nil {
+		sendError(w, http.StatusNotFound, err)
+		return
 	}
-	json.NewEncoder(w).Encode(sessions)
+	sendJson(w, build)
+}
+
+func (s *Api) RevokeBuild(w http.ResponseWriter, r *http.Request) {
+	err := s.server.RevokeBuild(mux.Vars(r)["Id"])
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	sendJson(w, s.server.Builds())
+}
+
+func (s *Api) GetSessions(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(s.server.Sessions())
 }
 
 func (s *Api) GetSession(w http.ResponseWriter, r *http.Request) {
@@ -52,6 +132,44 @@ func (s *Api) GetSession(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Api) GetSessionCommand(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	s.runOsCommand(w, session, mux.Vars(r)["Command"])
+}
+
+// runOsCommand sends the output of one of the OS commands, like netstat.
+func (s *Api) runOsCommand(w http.ResponseWriter, session *Session, name string) {
+	var stdout, stderr bytes.Buffer
+
+	command := Execute{
+		writer: &stdout,
+		errorWriter: &stderr,
+		command: s.server.osCommands[session.Os][name],
+		timeout: s.server.config.ExecuteTimeout(),
+	}
+	err := session.RunCommand(&command)
+	if err == nil {
+		err = command.err
+	}
+
+	output := CommandOutput{
+		Stdout: stdout.String(),
+		Stderr: stderr.String(),
+	}
+	if command.result != nil {
+		output.ExitCode = command.result.ExitCode
+	}
+	if err != nil {
+		output.Error = err.Error()
+	}
+
+	sendJson(w, output)
+}
+
+func (s *Api) CloseSession(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 
 	id, err := strconv.Atoi(params["Id"])
@@ -59,22 +177,382 @@ func (s *Api) GetSessionCommand(w http.ResponseWriter, r *http.Request) {
 
 	}
 
+	s.server.CloseSession(id)
+}
+
+func (s *Api) ListFiles(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		path = "."
+	}
+
+	entries, err := session.ListFiles(path)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	sendJson(w, entries)
+}
+
+func (s *Api) StatFile(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	entry, err := session.StatFile(r.URL.Query().Get("path"))
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	sendJson(w, entry)
+}
+
+func (s *Api) FileOperation(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	var operation FileOperation
+	err := json.NewDecoder(r.Body).Decode(&operation)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch mux.Vars(r)["Operation"] {
+	case "mkdir":
+		err = session.MakeDir(operation.Path, operation.Recursive)
+	case "remove":
+		err = session.RemoveFile(operation.Path, operation.Recursive)
+	case "move":
+		err = session.MoveFile(operation.Path, operation.Destination)
+	case "chmod":
+		err = session.ChmodFile(operation.Path, operation.Mode)
+	case "touch":
+		err = session.TouchFile(operation.Path)
+	default:
+		sendError(w, http.StatusNotFound, errors.New("Unknown operation"))
+		return
+	}
+
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	sendJson(w, operation)
+}
+
+func (s *Api) ListProcesses(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	processes, err := session.ListProcesses()
+	if _, ok := err.(*UnsupportedError); ok {
+		// The output of ps on the agents without a native listing
+		s.runOsCommand(w, session, "ps")
+		return
+	}
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	sendJson(w, processes)
+}
+
+func (s *Api) KillProcess(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	pid, err := strconv.Atoi(mux.Vars(r)["Pid"])
+	if err != nil {
+		sendError(w, http.StatusBadRequest, errors.New("Invalid process Id"))
+		return
+	}
+
+	err = session.KillProcess(pid)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	sendJson(w, ProcessParams{Pid: pid})
+}
+
+func (s *Api) ListConnections(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	connections, err := session.ListConnections()
+	if _, ok := err.(*UnsupportedError); ok {
+		// The output of netstat on the agents without a native listing
+		s.runOsCommand(w, session, "netstat")
+		return
+	}
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	sendJson(w, connections)
+}
+
+func (s *Api) ListInterfaces(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	interfaces, err := session.ListInterfaces()
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	sendJson(w, interfaces)
+}
+
+func (s *Api) AddSessionRoutes(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	subnets, err := s.server.AddSessionRoutes(session.Id)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	sendJson(w, subnets)
+}
+
+func (s *Api) getSession(w http.ResponseWriter, r *http.Request) *Session {
+	id, err := strconv.Atoi(mux.Vars(r)["Id"])
+	if err != nil {
+		sendError(w, http.StatusBadRequest, errors.New("Invalid session Id"))
+		return nil
+	}
+
 	session, err := s.server.GetSession(id)
+	if err != nil {
+		sendError(w, http.StatusNotFound, err)
+		return nil
+	}
+	return session
+}
 
-	command := params["Command"]
-	session.RunCommand(&Execute{
-		writer: w,
-		command: s.server.osCommands[session.Os][command],
+func sendJson(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func sendError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ApiError{Error: err.Error()})
+}
+
+func (s *Api) GetCompression(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+	sendJson(w, session.CompressionStats())
+}
+
+func (s *Api) SetCompression(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	var setting CompressionSetting
+	err := json.NewDecoder(r.Body).Decode(&setting)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = session.SetCompression(setting.Algorithm, setting.Streams)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	sendJson(w, session.CompressionStats())
+}
+
+func (s *Api) ListTransfers(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+	sendJson(w, session.Transfers())
+}
+
+// StartTransfer returns as soon as the transfer is started, its progress
+// is then polled with GetTransfer.
+func (s *Api) StartTransfer(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	var request TransferRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	transfer, err := session.NewTransfer(request.Type, request.Source, request.Destination, ArchiveOptions{
+		Compression: request.Compression,
+		Include: request.Include,
+		Exclude: request.Exclude,
 	})
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	go session.RunTransfer(transfer)
+	sendJson(w, transfer.Progress())
 }
 
-func (s *Api) CloseSession(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
+func (s *Api) GetTransfer(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
 
-	id, err := strconv.Atoi(params["Id"])
+	id, err := strconv.Atoi(mux.Vars(r)["TransferId"])
+	if err != nil {
+		sendError(w, http.StatusBadRequest, errors.New("Invalid transfer Id"))
+		return
+	}
+
+	transfer, err := session.GetTransfer(id)
 	if err != nil {
+		sendError(w, http.StatusNotFound, err)
+		return
+	}
+	sendJson(w, transfer.Progress())
+}
 
+func (s *Api) ListShells(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
 	}
 
-	s.server.CloseSession(id)
-}
\ No newline at end of file
+	shells, err := session.ListShells()
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	sendJson(w, shells)
+}
+
+func (s *Api) KillShell(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	name := mux.Vars(r)["Name"]
+	err := session.KillShell(name)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	sendJson(w, ShellParams{Name: name})
+}
+
+// ListNotes returns the notes of the session.
+func (s *Api) ListNotes(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+	sendJson(w, session.Notes())
+}
+
+func (s *Api) AddNote(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	var note Note
+	err := json.NewDecoder(r.Body).Decode(&note)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	session.AddNote(note.Text)
+	sendJson(w, session.Notes())
+}
+
+// Lifecycle disconnects, terminates or uninstalls the agent, an optional
+// "delay" query parameter sets the seconds before the agent reconnects.
+func (s *Api) Lifecycle(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	var result *LifecycleResult
+	var err error
+
+	switch mux.Vars(r)["Action"] {
+	case "disconnect":
+		var delay int
+		if value := r.URL.Query().Get("delay"); value != "" {
+			delay, err = strconv.Atoi(value)
+			if err != nil {
+				sendError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		result, err = session.Disconnect(time.Duration(delay) * time.Second)
+	case "terminate":
+		result, err = session.Terminate()
+	case "uninstall":
+		result, err = session.Uninstall()
+	}
+
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	sendJson(w, result)
+}
+
+// Ping returns the round trip time in milliseconds.
+func (s *Api) Ping(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	latency, err := session.Ping(s.server.config.KeepaliveTimeout())
+	if err != nil {
+		sendError(w, http.StatusGatewayTimeout, err)
+		return
+	}
+
+	lastSeen, _ := session.LastSeen()
+	sendJson(w, PingResult{
+		Latency: float64(latency) / float64(time.Millisecond),
+		LastSeen: lastSeen,
+	})
+}
@@ -0,0 +1,251 @@
+package gomet
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type ArchiveOptions struct {
+	Compression string
+	Include []string
+	Exclude []string
+}
+
+// matchPatterns tells if the slash separated relative path or its base
+// name matches one of the glob patterns.
+func matchPatterns(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if match, _ := filepath.Match(pattern, path); match {
+			return true
+		}
+		if match, _ := filepath.Match(pattern, filepath.Base(path)); match {
+			return true
+		}
+	}
+	return false
+}
+
+// writeArchive writes root as a tar archive. Directories are always walked,
+// include patterns only filter files and exclude patterns skip whole trees.
+func writeArchive(writer io.Writer, root string, include []string, exclude []string) (*ArchiveResult, error) {
+	var result ArchiveResult
+
+	archive := tar.NewWriter(writer)
+
+	root = filepath.Clean(root)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(filepath.Dir(root), path)
+		if err != nil {
+			return err
+		}
+		relative = filepath.ToSlash(relative)
+
+		if path != root && matchPatterns(exclude, relative) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.IsDir() && len(include) > 0 && !matchPatterns(include, relative) {
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+
+		header.Name = relative
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		err = archive.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+
+		size, err := io.Copy(archive, file)
+		result.Files++
+		result.Size += size
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return &result, archive.Close()
+}
+
+// extractArchive extracts a tar archive in destination, keeping modes and
+// modification times. Entries escaping destination are refused.
+func extractArchive(reader io.Reader, destination string) (*ArchiveResult, error) {
+	var result ArchiveResult
+
+	type dirTime struct {
+		path    string
+		mode    os.FileMode
+		modTime time.Time
+	}
+	var dirTimes []dirTime
+
+	destination = filepath.Clean(destination)
+
+	err := os.MkdirAll(destination, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		path := filepath.Join(destination, filepath.FromSlash(header.Name))
+		if path != destination && !strings.HasPrefix(path, destination+string(os.PathSeparator)) {
+			return nil, errors.New("Invalid path in archive " + header.Name)
+		}
+
+		err = checkParents(destination, path)
+		if err != nil {
+			return nil, err
+		}
+
+		mode := os.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, mode|0700)
+			if err == nil {
+				dirTimes = append(dirTimes, dirTime{path: path, mode: mode, modTime: header.ModTime})
+			}
+		case tar.TypeSymlink:
+			if !linkInside(destination, path, header.Linkname) {
+				return nil, errors.New("Invalid link in archive " + header.Name + " -> " + header.Linkname)
+			}
+			os.Remove(path)
+			err = os.Symlink(header.Linkname, path)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(archive, path, mode, header.ModTime)
+			if err == nil {
+				result.Files++
+				result.Size += header.Size
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Directories modes and times are restored once their content is written
+	for i := len(dirTimes) - 1; i >= 0; i-- {
+		os.Chmod(dirTimes[i].path, dirTimes[i].mode)
+		os.Chtimes(dirTimes[i].path, dirTimes[i].modTime, dirTimes[i].modTime)
+	}
+
+	return &result, nil
+}
+
+// checkParents refuses to write path through a symbolic link, an earlier
+// entry of the archive could link outside destination.
+func checkParents(destination string, path string) error {
+	relative, err := filepath.Rel(destination, filepath.Dir(path))
+	if err != nil || relative == "." {
+		return err
+	}
+
+	parent := destination
+	for _, name := range strings.Split(relative, string(os.PathSeparator)) {
+		parent = filepath.Join(parent, name)
+		info, err := os.Lstat(parent)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errors.New("Invalid path through a link in archive " + path)
+		}
+	}
+	return nil
+}
+
+// linkInside tells if a link created at path targets destination or its
+// content. ".." is only allowed at the start of the target so it can't go
+// up through another link.
+func linkInside(destination string, path string, target string) bool {
+	if target == "" || filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+		return false
+	}
+
+	up := true
+	for _, name := range strings.Split(filepath.ToSlash(target), "/") {
+		if name == ".." && !up {
+			return false
+		}
+		up = up && (name == ".." || name == ".")
+	}
+	resolved := filepath.Join(filepath.Dir(path), filepath.FromSlash(target))
+	return resolved == destination || strings.HasPrefix(resolved, destination+string(os.PathSeparator))
+}
+
+func extractFile(reader io.Reader, path string, mode os.FileMode, modTime time.Time) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, reader)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(path, mode)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, modTime, modTime)
+}
@@ -0,0 +1,153 @@
+package gomet
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const failedConnectionsFile = "logs/failed_connections.log"
+
+var failedConnectionsLock sync.Mutex
+
+// Agents authenticate after the CONNECT line:
+//
+//   agent  > Build: <build id>, then an empty line
+//   server > Challenge: <hex nonce>
+//   agent  > Response: <hex HMAC-SHA256 of the nonce and the build id, keyed by the build secret>
+//   server > HTTP/1.1 200 OK, then an empty line
+//
+// The session starts once the agent read the empty line.
+
+// authenticateAgent returns the build of the agent, the build must be
+// registered and not revoked, present its client certificate and answer the
+// challenge with its secret. The build id is returned with the error when
+// the agent sent one.
+func (s *Server) authenticateAgent(conn net.Conn, reader *bufio.Reader) (string, error) {
+	headers := readHttpHeaders(reader)
+	buildId := headers["build"]
+	if buildId == "" {
+		return "", errors.New("No build id")
+	}
+
+	build, err := s.builds.Get(buildId)
+	if err != nil {
+		return buildId, err
+	}
+	if build.Revoked() {
+		return buildId, errors.New("Build " + buildId + " is revoked")
+	}
+	if build.Secret == "" {
+		return buildId, errors.New("Build " + buildId + " has no secret, it must be generated again")
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return buildId, errors.New("Not a TLS connection")
+	}
+
+	certificates := tlsConn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return buildId, errors.New("No client certificate")
+	}
+
+	certificate := certificates[0]
+	if certificate.Subject.CommonName != buildId {
+		return buildId, errors.New("Build " + buildId + " presented the certificate of " + certificate.Subject.CommonName)
+	}
+
+	err = s.builds.Check(buildId, certificate.SerialNumber.Text(16))
+	if err != nil {
+		return buildId, err
+	}
+
+	err = challengeAgent(conn, reader, build)
+	if err != nil {
+		return buildId, err
+	}
+
+	_, err = conn.Write([]byte("HTTP/1.1 200 OK\n\n"))
+	return buildId, err
+}
+
+// challengeAgent checks the agent knows the secret of the build.
+func challengeAgent(conn net.Conn, reader *bufio.Reader, build Build) error {
+	nonce := make([]byte, 32)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	_, err = conn.Write([]byte("Challenge: " + hex.EncodeToString(nonce) + "\n"))
+	if err != nil {
+		return err
+	}
+
+	line, _, err := reader.ReadLine()
+	if err != nil {
+		return err
+	}
+
+	response, err := hex.DecodeString(strings.TrimSpace(strings.TrimPrefix(string(line), "Response:")))
+	if err != nil {
+		return errors.New("Invalid challenge response")
+	}
+
+	secret, err := hex.DecodeString(build.Secret)
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	mac.Write([]byte(build.Id))
+	if !hmac.Equal(response, mac.Sum(nil)) {
+		return errors.New("Wrong challenge response for build " + build.Id)
+	}
+	return nil
+}
+
+// randomSecret returns the hex secret of a new build.
+func randomSecret() (string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// logFailedConnection records a refused agent in logs/failed_connections.log.
+func (s *Server) logFailedConnection(conn net.Conn, buildId string, err error) {
+	log.Printf("Session refused from %s: %s", conn.RemoteAddr(), err)
+
+	if buildId == "" {
+		buildId = "-"
+	}
+
+	failedConnectionsLock.Lock()
+	defer failedConnectionsLock.Unlock()
+
+	file, fileErr := os.OpenFile(failedConnectionsFile, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0600)
+	if fileErr != nil {
+		log.Printf("ERROR %s", fileErr)
+		return
+	}
+	defer file.Close()
+
+	fmt.Fprintf(file, "%s\t%s\t%s\t%s\n", time.Now().Format(time.RFC3339), conn.RemoteAddr(), buildId, err)
+}
@@ -0,0 +1,270 @@
+package gomet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const buildsFile = "config/builds.json"
+
+// Build is a generated agent, identified by the client certificate it
+// presents to the listener. It records the settings built into the agent
+// and where the binary was delivered, the proxy password isn't kept.
+type Build struct {
+	Id             string          `json:"id"`
+	Os             string          `json:"os"`
+	Arch           string          `json:"arch"`
+	Host           string          `json:"host"`
+	HttpProxy      string          `json:"httpProxy,omitempty"`
+	HttpsProxy     string          `json:"httpsProxy,omitempty"`
+	ProxyUsername  string          `json:"proxyUsername,omitempty"`
+	KillDate       *time.Time      `json:"killDate,omitempty"`
+	OperatingHours string          `json:"operatingHours,omitempty"`
+	Reconnect      ReconnectPolicy `json:"reconnect"`
+	Sha256         string          `json:"sha256"`
+	Size           int             `json:"size"`
+	Deliveries     []string        `json:"deliveries,omitempty"`
+	Serial         string          `json:"serial"`
+	Secret         string          `json:"secret,omitempty"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	RevokedAt      *time.Time      `json:"revokedAt,omitempty"`
+}
+
+func (b *Build) Revoked() bool {
+	return b.RevokedAt != nil
+}
+
+// BuildRegistry keeps the builds in config/builds.json.
+type BuildRegistry struct {
+	lock sync.Mutex
+	builds map[string]*Build
+}
+
+func loadBuildRegistry() (*BuildRegistry, error) {
+	registry := BuildRegistry{builds: make(map[string]*Build)}
+
+	content, err := ioutil.ReadFile(buildsFile)
+	if os.IsNotExist(err) {
+		return &registry, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var builds []*Build
+	err = json.Unmarshal(content, &builds)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, build := range builds {
+		registry.builds[build.Id] = build
+	}
+	return &registry, nil
+}
+
+// save must be called with the lock held.
+func (r *BuildRegistry) save() error {
+	content, err := json.MarshalIndent(r.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(buildsFile, content, 0600)
+}
+
+// list must be called with the lock held.
+func (r *BuildRegistry) list() []*Build {
+	builds := make([]*Build, 0, len(r.builds))
+	for _, build := range r.builds {
+		builds = append(builds, build)
+	}
+	sort.Slice(builds, func(i, j int) bool {
+		return builds[i].CreatedAt.Before(builds[j].CreatedAt)
+	})
+	return builds
+}
+
+func (r *BuildRegistry) Add(build *Build) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.builds[build.Id] = build
+	return r.save()
+}
+
+// List returns copies of the builds sorted by creation time.
+func (r *BuildRegistry) List() []Build {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	builds := make([]Build, 0, len(r.builds))
+	for _, build := range r.list() {
+		builds = append(builds, *build)
+	}
+	return builds
+}
+
+func (r *BuildRegistry) Get(id string) (Build, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	build, ok := r.builds[id]
+	if !ok {
+		return Build{}, errors.New("Unknown build " + id)
+	}
+	return *build, nil
+}
+
+// AddDelivery records where the binary of the build was placed.
+func (r *BuildRegistry) AddDelivery(id string, delivery string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	build, ok := r.builds[id]
+	if !ok {
+		return errors.New("Unknown build " + id)
+	}
+
+	build.Deliveries = append(build.Deliveries, delivery)
+	return r.save()
+}
+
+func (r *BuildRegistry) Revoke(id string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	build, ok := r.builds[id]
+	if !ok {
+		return errors.New("Unknown build " + id)
+	}
+	if build.Revoked() {
+		return errors.New("Build " + id + " is already revoked")
+	}
+
+	now := time.Now()
+	build.RevokedAt = &now
+	return r.save()
+}
+
+// Check allows a build presenting the certificate with serial.
+func (r *BuildRegistry) Check(id string, serial string) error {
+	build, err := r.Get(id)
+	if err != nil {
+		return err
+	}
+	if build.Serial != serial {
+		return errors.New("Unknown certificate for build " + id)
+	}
+	if build.Revoked() {
+		return errors.New("Build " + id + " is revoked")
+	}
+	return nil
+}
+
+func printBuilds(writer io.Writer, builds []Build) {
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	for _, build := range builds {
+		status := "active"
+		if build.Revoked() {
+			status = "revoked " + build.RevokedAt.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(table, "%s\t%s/%s\t%s\t%s\t%s\n",
+			build.Id,
+			build.Os,
+			build.Arch,
+			build.Host,
+			build.CreatedAt.Local().Format("2006-01-02 15:04"),
+			status)
+	}
+	table.Flush()
+}
+
+func printBuild(writer io.Writer, build Build, sessions []*Session) {
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "Id:\t%s\n", build.Id)
+	fmt.Fprintf(table, "OS/Arch:\t%s/%s\n", build.Os, build.Arch)
+	fmt.Fprintf(table, "Host:\t%s\n", build.Host)
+	if build.HttpProxy != "" {
+		fmt.Fprintf(table, "HTTP proxy:\t%s\n", build.HttpProxy)
+	}
+	if build.HttpsProxy != "" {
+		fmt.Fprintf(table, "HTTPS proxy:\t%s\n", build.HttpsProxy)
+	}
+	if build.ProxyUsername != "" {
+		fmt.Fprintf(table, "Proxy username:\t%s\n", build.ProxyUsername)
+	}
+	killDate := "none"
+	if build.KillDate != nil {
+		killDate = build.KillDate.Local().Format("2006-01-02 15:04")
+	}
+	fmt.Fprintf(table, "Kill date:\t%s\n", killDate)
+	if build.OperatingHours != "" {
+		fmt.Fprintf(table, "Operating hours:\t%s\n", build.OperatingHours)
+	}
+	fmt.Fprintf(table, "Reconnect:\tevery %ds, up to %ds, %d retries\n", build.Reconnect.Interval, build.Reconnect.MaxInterval, build.Reconnect.MaxRetries)
+	fmt.Fprintf(table, "SHA-256:\t%s\n", build.Sha256)
+	fmt.Fprintf(table, "Size:\t%d\n", build.Size)
+	fmt.Fprintf(table, "Created:\t%s\n", build.CreatedAt.Local().Format("2006-01-02 15:04:05"))
+	if build.Revoked() {
+		fmt.Fprintf(table, "Revoked:\t%s\n", build.RevokedAt.Local().Format("2006-01-02 15:04:05"))
+	}
+	for _, delivery := range build.Deliveries {
+		fmt.Fprintf(table, "Delivery:\t%s\n", delivery)
+	}
+	for _, session := range sessions {
+		fmt.Fprintf(table, "Session:\t%d - %s\n", session.Id, session.String())
+	}
+	table.Flush()
+}
+
+/* -----------------
+   Server
+  ------------------ */
+
+// Builds returns the builds without their secret.
+func (s *Server) Builds() []Build {
+	builds := s.builds.List()
+	for i := range builds {
+		builds[i].Secret = ""
+	}
+	return builds
+}
+
+// Build returns a build without its secret.
+func (s *Server) Build(id string) (Build, error) {
+	build, err := s.builds.Get(id)
+	build.Secret = ""
+	return build, err
+}
+
+// BuildSessions returns the sessions opened by the agents of a build.
+func (s *Server) BuildSessions(id string) []*Session {
+	var sessions []*Session
+	for _, session := range s.Sessions() {
+		if session.BuildId == id {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// RevokeBuild refuses new sessions of the build and closes its sessions.
+func (s *Server) RevokeBuild(id string) error {
+	err := s.builds.Revoke(id)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range s.BuildSessions(id) {
+		s.closeSession(session.Id, "Build " + id + " revoked")
+	}
+	return nil
+}
@@ -5,7 +5,11 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type CLI struct {
@@ -105,6 +109,52 @@ func (t *CLI) registerServerCommands() {
 		Func: t.generateAgent,
 	})
 
+	buildsCmd := ishell.Cmd{
+		Name: "builds",
+		Help: "List generated agents",
+		Func: t.listBuilds,
+	}
+
+	t.shell.AddCmd(&buildsCmd)
+
+	buildsCmd.AddCmd(&ishell.Cmd{
+		Name: "list",
+		Help: "List generated agents",
+		Func: t.listBuilds,
+	})
+
+	buildsCmd.AddCmd(&ishell.Cmd{
+		Name: "show",
+		Help: "Show a build and its sessions",
+		Func: t.showBuild,
+	})
+
+	buildsCmd.AddCmd(&ishell.Cmd{
+		Name: "revoke",
+		Help: "Revoke the certificate of a build",
+		Func: t.revokeBuild,
+	})
+
+	certsCmd := ishell.Cmd{
+		Name: "certs",
+		Help: "List server certificates",
+		Func: t.listServerCertificates,
+	}
+
+	t.shell.AddCmd(&certsCmd)
+
+	certsCmd.AddCmd(&ishell.Cmd{
+		Name: "create",
+		Help: "Create a server certificate, pinned by the next agents",
+		Func: t.createServerCertificate,
+	})
+
+	certsCmd.AddCmd(&ishell.Cmd{
+		Name: "rotate",
+		Help: "Activate a server certificate created earlier",
+		Func: t.rotateServerCertificate,
+	})
+
 	t.shell.AddCmd(&ishell.Cmd{
 		Name: "info",
 		Help: "Print server information",
@@ -135,6 +185,48 @@ func (t *CLI) registerSessionCommands(sessionId int) {
 		Func: t.suspendCurrentSession,
 	})
 
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "disconnect",
+		Help: "Disconnect the agent, it reconnects later",
+		Func: t.disconnectAgent,
+	})
+
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "terminate",
+		Help: "Terminate the agent process",
+		Func: t.terminateAgent,
+	})
+
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "uninstall",
+		Help: "Terminate the agent and remove its executable and lockfile",
+		Func: t.uninstallAgent,
+	})
+
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "info",
+		Help: "Print session information",
+		Func: t.printSessionInfo,
+	})
+
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "ping",
+		Help: "Measure the round trip time to the agent",
+		Func: t.ping,
+	})
+
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "note",
+		Help: "Add a note to the session",
+		Func: t.addNote,
+	})
+
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "notes",
+		Help: "List the notes of the session",
+		Func: t.listNotes,
+	})
+
 	jobCmd := ishell.Cmd{
 		Name: "jobs",
 		Help: "List jobs",
@@ -162,53 +254,95 @@ func (t *CLI) registerSessionCommands(sessionId int) {
 		Func: t.killStream,
 	})
 
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "compression",
+		Help: "Show or set stream compression",
+		Func: t.compression,
+	})
+
 	t.shell.AddCmd(&ishell.Cmd{
 		Name: "execute",
-		Help: "Execute a command",
-		Func: func(c *ishell.Context) {
-			t.runCommand(&Execute{
-				writer: os.Stdout,
-				command: readParameter(c, "Command: "),
-			})
-		},
+		Help: "Execute a command, Ctrl-C cancels it",
+		Func: t.execute,
 	})
 
 	t.shell.AddCmd(&ishell.Cmd{
 		Name: "upload",
-		Help: "Upload a file",
-		Func: func(c *ishell.Context) {
-			t.currentSession.UploadFile(readParameter(c, "Local file: "), readParameter(c, "Remote file: "))
-		},
+		Help: "Upload a file or directory",
+		Func: t.upload,
 	})
 
 	t.shell.AddCmd(&ishell.Cmd{
 		Name: "download",
-		Help: "Download a file",
-		Func: func(c *ishell.Context) {
-			t.currentSession.DownloadFile(readParameter(c, "Remote file: "), readParameter(c, "Local file: "))
-		},
+		Help: "Download a file or directory",
+		Func: t.download,
+	})
+
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "transfers",
+		Help: "List transfers and their progress",
+		Func: t.listTransfers,
 	})
 
 	t.shell.AddCmd(&ishell.Cmd{
 		Name: "shell",
-		Help: "Interactive remote shell",
-		Func: func(c *ishell.Context) {
-			t.runCommand(&Shell{
-				writer: os.Stdout,
-				reader: os.Stdin,
-			})
-		},
+		Help: "Interactive remote shell, named shells can be detached with Ctrl-]",
+		Func: t.runShell,
+	})
+
+	shellsCmd := ishell.Cmd{
+		Name: "shells",
+		Help: "List named shells",
+		Func: t.listShells,
+	}
+	t.shell.AddCmd(&shellsCmd)
+
+	shellsCmd.AddCmd(&ishell.Cmd{
+		Name: "kill",
+		Help: "Kill a named shell",
+		Func: t.killShell,
 	})
 
 	t.shell.AddCmd(&ishell.Cmd{
 		Name: "ls",
 		Help: "List files",
-		Func: func(c *ishell.Context) {
-			t.runCommand(&Execute{
-				writer: os.Stdout,
-				command: t.server.osCommands[t.currentSession.Os]["ls"],
-			})
-		},
+		Func: t.listFiles,
+	})
+
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "stat",
+		Help: "Print file information",
+		Func: t.statFile,
+	})
+
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "mkdir",
+		Help: "Make a directory",
+		Func: t.makeDir,
+	})
+
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "rm",
+		Help: "Remove a file or directory",
+		Func: t.removeFile,
+	})
+
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "mv",
+		Help: "Move or rename a file",
+		Func: t.moveFile,
+	})
+
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "chmod",
+		Help: "Change file mode",
+		Func: t.chmodFile,
+	})
+
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "touch",
+		Help: "Create a file or update its time",
+		Func: t.touchFile,
 	})
 
 	t.shell.AddCmd(&ishell.Cmd{
@@ -217,6 +351,7 @@ func (t *CLI) registerSessionCommands(sessionId int) {
 		Func: func(c *ishell.Context) {
 			t.runCommand(&Execute{
 				writer: os.Stdout,
+				errorWriter: os.Stderr,
 				command: t.server.osCommands[t.currentSession.Os]["id"],
 			})
 		},
@@ -225,44 +360,63 @@ func (t *CLI) registerSessionCommands(sessionId int) {
 	t.shell.AddCmd(&ishell.Cmd{
 		Name: "pwd",
 		Help: "Get current directory",
-		Func: func(c *ishell.Context) {
-			t.runCommand(&Execute{
-				writer: os.Stdout,
-				command: t.server.osCommands[t.currentSession.Os]["pwd"],
-			})
-		},
+		Func: t.printWorkingDirectory,
+	})
+
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "cd",
+		Help: "Change the session directory",
+		Func: t.changeDirectory,
+	})
+
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "setenv",
+		Help: "Set a session environment variable, or list them",
+		Func: t.setEnv,
+	})
+
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "unsetenv",
+		Help: "Unset a session environment variable",
+		Func: t.unsetEnv,
 	})
 
 	t.shell.AddCmd(&ishell.Cmd{
 		Name: "ps",
 		Help: "List processes",
-		Func: func(c *ishell.Context) {
-			t.runCommand(&Execute{
-				writer: os.Stdout,
-				command: t.server.osCommands[t.currentSession.Os]["ps"],
-			})
-		},
+		Func: t.listProcesses,
+	})
+
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "kill",
+		Help: "Kill a process",
+		Func: t.killProcess,
 	})
 
 	t.shell.AddCmd(&ishell.Cmd{
 		Name: "netstat",
 		Help: "List connections",
-		Func: func(c *ishell.Context) {
-			t.runCommand(&Execute{
-				writer: os.Stdout,
-				command: t.server.osCommands[t.currentSession.Os]["netstat"],
-			})
-		},
+		Func: t.listConnections,
+	})
+
+	t.shell.AddCmd(&ishell.Cmd{
+		Name: "ifconfig",
+		Help: "List network interfaces",
+		Func: t.listInterfaces,
 	})
 
 	t.shell.AddCmd(&ishell.Cmd{
 		Name: "cat",
 		Help: "Print a file",
 		Func: func(c *ishell.Context) {
-			t.runCommand(&Download{
+			download := Download{
 				writer: os.Stdout,
 				remoteFilename: readParameter(c, "Remote file: "),
-			})
+			}
+			t.runCommand(&download)
+			if download.err != nil {
+				c.Println(download.err)
+			}
 		},
 	})
 
@@ -310,14 +464,19 @@ func (t* CLI) exit(c *ishell.Context) {
 
 func (t *CLI) listSessions(c *ishell.Context) {
 
-	if len(t.server.sessions) == 0 {
+	sessions := t.server.Sessions()
+	if len(sessions) == 0 {
 		c.Println("No sessions")
 		return
 	}
 
 	c.Println("Sessions:")
-	for key, session := range t.server.sessions {
-		c.Printf("%5d - %s\n", key, session.String())
+	for _, session := range sessions {
+		state := ""
+		if disconnected, _ := session.Disconnected(); disconnected {
+			state = " - disconnected"
+		}
+		c.Printf("%5d - %s - %s (pid %d) - build %s - agent %s - expires %s%s\n", session.Id, session.String(), session.User, session.Pid, session.BuildId, session.AgentVersion, session.Expiry(), state)
 	}
 }
 
@@ -353,29 +512,42 @@ func (t *CLI) closeSession(c *ishell.Context) {
 
 
 func (t *CLI) listRoutes(c *ishell.Context) {
-	if len(t.server.routes) == 0 {
+	routes := t.server.Routes()
+	if len(routes) == 0 {
 		c.Println("No routes")
 		return
 	}
 
 	c.Println("Routes:")
-	for key, session := range t.server.routes {
+	for key, session := range routes {
 		c.Printf("%s - %s\n", key, session.String())
 	}
 }
 
 func (t *CLI) addRoute(c *ishell.Context) {
-	if len(c.Args) != 2 {
-		c.Println("Usage: routes add <range> <sessionId>")
+	if len(c.Args) != 1 && len(c.Args) != 2 {
+		c.Println("Usage: routes add [<range>] <sessionId>")
 		return
 	}
 
-	id, err := strconv.Atoi(c.Args[1])
+	id, err := strconv.Atoi(c.Args[len(c.Args) - 1])
 	if err != nil {
 		c.Println("Invalid session Id")
 		return
 	}
 
+	if len(c.Args) == 1 {
+		subnets, err := t.server.AddSessionRoutes(id)
+		if err != nil {
+			c.Println(err)
+			return
+		}
+		for _, subnet := range subnets {
+			c.Printf("Route %s added\n", subnet)
+		}
+		return
+	}
+
 	err = t.server.AddRoute(c.Args[0], id)
 
 	if err!= nil {
@@ -396,6 +568,70 @@ func (t *CLI) delRoute(c *ishell.Context) {
 	}
 }
 
+func (t *CLI) listBuilds(c *ishell.Context) {
+	builds := t.server.Builds()
+	if len(builds) == 0 {
+		c.Println("No builds")
+		return
+	}
+	printBuilds(os.Stdout, builds)
+}
+
+// builds show <build>
+func (t *CLI) showBuild(c *ishell.Context) {
+	if len(c.Args) != 1 {
+		c.Println("Usage: builds show <build>")
+		return
+	}
+
+	build, err := t.server.Build(c.Args[0])
+	if err != nil {
+		c.Println(err)
+		return
+	}
+	printBuild(os.Stdout, build, t.server.BuildSessions(build.Id))
+}
+
+func (t *CLI) revokeBuild(c *ishell.Context) {
+	if len(c.Args) != 1 {
+		c.Println("Usage: builds revoke <build>")
+		return
+	}
+
+	err := t.server.RevokeBuild(c.Args[0])
+	if err != nil {
+		c.Println(err)
+	}
+}
+
+func (t *CLI) listServerCertificates(c *ishell.Context) {
+	printServerCertificates(os.Stdout, t.server.ServerCertificates())
+}
+
+func (t *CLI) createServerCertificate(c *ishell.Context) {
+	certificate, err := t.server.CreateServerCertificate()
+	if err != nil {
+		c.Println(err)
+		return
+	}
+	c.Printf("Certificate %s created, agents generated from now on accept it\n", certificate.Id)
+}
+
+// certs rotate <id>
+func (t *CLI) rotateServerCertificate(c *ishell.Context) {
+	if len(c.Args) != 1 {
+		c.Println("Usage: certs rotate <id>")
+		return
+	}
+
+	certificate, err := t.server.RotateServerCertificate(c.Args[0])
+	if err != nil {
+		c.Println(err)
+		return
+	}
+	c.Printf("Certificate %s active\n", certificate.Id)
+}
+
 func (t *CLI) clearRoutes(c *ishell.Context) {
 	t.server.ClearRoutes()
 }
@@ -413,9 +649,218 @@ func (t *CLI) closeCurrentSession(c *ishell.Context) {
 	}
 }
 
+// disconnect [<seconds>] before the agent reconnects, its reconnect interval by default.
+func (t *CLI) disconnectAgent(c *ishell.Context) {
+	var delay time.Duration
+	if len(c.Args) > 0 {
+		seconds, err := strconv.Atoi(c.Args[0])
+		if err != nil || seconds < 0 {
+			c.Println("Usage: disconnect [<seconds>]")
+			return
+		}
+		delay = time.Duration(seconds) * time.Second
+	}
+
+	result, err := t.currentSession.Disconnect(delay)
+	if err != nil {
+		c.Println(err)
+		return
+	}
+	printLifecycleResult(os.Stdout, "disconnect", result)
+}
+
+func (t *CLI) terminateAgent(c *ishell.Context) {
+	result, err := t.currentSession.Terminate()
+	if err != nil {
+		c.Println(err)
+		return
+	}
+	printLifecycleResult(os.Stdout, "terminate", result)
+}
+
+func (t *CLI) uninstallAgent(c *ishell.Context) {
+	result, err := t.currentSession.Uninstall()
+	if err != nil {
+		c.Println(err)
+		return
+	}
+	printLifecycleResult(os.Stdout, "uninstall", result)
+}
+
+func (t *CLI) printSessionInfo(c *ishell.Context) {
+	session := t.currentSession
+
+	c.Printf("Hostname: %s\n", session.Hostname)
+	c.Printf("Address: %s\n", session.Address)
+	c.Printf("OS/Arch: %s/%s\n", session.Os, session.Arch)
+	c.Printf("User: %s (uid %s, gid %s)\n", session.User, session.Uid, session.Gid)
+	c.Printf("PID: %d\n", session.Pid)
+	c.Printf("Working directory: %s\n", session.Cwd)
+	if cwd, _ := session.Environment(); cwd != "" {
+		c.Printf("Session directory: %s\n", cwd)
+	}
+	c.Printf("Agent: %s version %s, protocol %d\n", session.AgentId, session.AgentVersion, session.Version)
+	c.Printf("Build: %s\n", session.BuildId)
+	c.Printf("Expires: %s\n", session.Expiry())
+	if session.OperatingHours != "" {
+		c.Printf("Operating hours: %s\n", session.OperatingHours)
+	}
+	c.Printf("Compressions: %s\n", strings.Join(session.Compressions, ", "))
+
+	lastSeen, latency := session.LastSeen()
+	c.Printf("Last seen: %s (latency %s)\n", lastSeen.Local().Format("2006-01-02 15:04:05"), latency)
+	if disconnected, reason := session.Disconnected(); disconnected {
+		c.Printf("Disconnected: %s\n", reason)
+	}
+
+	c.Println("Interfaces:")
+	printInterfaces(os.Stdout, session.Interfaces)
+}
+
+// note <text>
+func (t *CLI) addNote(c *ishell.Context) {
+	if len(c.Args) == 0 {
+		c.Println("Usage: note <text>")
+		return
+	}
+	t.currentSession.AddNote(strings.Join(c.Args, " "))
+}
+
+func (t *CLI) listNotes(c *ishell.Context) {
+	for _, note := range t.currentSession.Notes() {
+		c.Printf("%s  %s\n", note.Time.Local().Format("2006-01-02 15:04:05"), note.Text)
+	}
+}
+
+func (t *CLI) ping(c *ishell.Context) {
+	latency, err := t.currentSession.Ping(t.server.config.KeepaliveTimeout())
+	if err != nil {
+		c.Println(err)
+		return
+	}
+	c.Printf("Reply from %s in %s\n", t.currentSession.Hostname, latency)
+}
+
+// compression [none|gzip|zstd [<stream>...]]
+func (t *CLI) compression(c *ishell.Context) {
+	if len(c.Args) > 0 {
+		algorithm := c.Args[0]
+		if algorithm == "none" {
+			algorithm = CompressionNone
+		}
+
+		err := t.currentSession.SetCompression(algorithm, c.Args[1:])
+		if err != nil {
+			c.Println(err)
+			return
+		}
+	}
+
+	printCompressionStats(os.Stdout, t.currentSession.CompressionStats())
+}
+
+// shell [<name>] attaches to the named shell, started if needed.
+func (t *CLI) runShell(c *ishell.Context) {
+	shell := Shell{
+		writer: os.Stdout,
+		reader: os.Stdin,
+		terminal: newLocalTerminal(os.Stdin),
+	}
+	if len(c.Args) > 0 {
+		shell.name = c.Args[0]
+	}
+
+	t.runCommand(&shell)
+	if shell.name == "" || shell.result == nil {
+		return
+	}
+
+	t.currentSession.trackShell(shell.name, shell.result.Exited)
+	if shell.result.Exited {
+		c.Printf("Shell %s exited with code %d\n", shell.name, shell.result.ExitCode)
+	} else {
+		c.Printf("Detached from shell %s\n", shell.name)
+	}
+}
+
+func (t *CLI) listShells(c *ishell.Context) {
+	shells, err := t.currentSession.ListShells()
+	if err != nil {
+		c.Println(err)
+		return
+	}
+	printShells(os.Stdout, shells)
+}
+
+func (t *CLI) killShell(c *ishell.Context) {
+	if len(c.Args) != 1 {
+		c.Println("Usage: shells kill <name>")
+		return
+	}
+
+	err := t.currentSession.KillShell(c.Args[0])
+	if err != nil {
+		c.Println(err)
+	}
+}
+
+// execute [-t <seconds>] [<command>], the default timeout comes from the configuration.
+func (t *CLI) execute(c *ishell.Context) {
+	timeout, command, err := parseExecuteOptions(c.Args, t.server.config.ExecuteTimeout())
+	if err != nil {
+		c.Println("Usage: execute [-t <seconds>] [<command>]")
+		return
+	}
+
+	if command == "" {
+		command = readParameter(c, "Command: ")
+	}
+
+	execute := Execute{
+		writer: os.Stdout,
+		errorWriter: os.Stderr,
+		command: command,
+		timeout: timeout,
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-interrupt:
+			execute.Cancel()
+		case <-done:
+		}
+	}()
+
+	t.runCommand(&execute)
+	signal.Stop(interrupt)
+	close(done)
+
+	if execute.result == nil {
+		return
+	}
+
+	if execute.result.Canceled {
+		c.Println("Canceled")
+	} else if execute.result.TimedOut {
+		c.Printf("Timed out after %s\n", timeout)
+	} else {
+		c.Printf("Exit code: %d\n", execute.result.ExitCode)
+	}
+}
+
 func (t *CLI) listJobs(c *ishell.Context) {
-	for key, job := range t.currentSession.jobs {
-		c.Printf("%5d - %s\n", key, *job)
+	jobs := t.currentSession.Jobs()
+	ids := make([]int, 0, len(jobs))
+	for id := range jobs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		c.Printf("%5d - %s\n", id, jobs[id])
 	}
 }
 
@@ -425,13 +870,12 @@ func (t *CLI) killJob(c *ishell.Context) {
 		c.Printf("Invalid job Id")
 		return
 	}
-	if job, ok := t.currentSession.jobs[id]; ok {
-		(*job).Stop()
-		delete(t.currentSession.jobs, id)
-		c.Printf("Job %d killed\n", id)
-	} else {
-		c.Println("Invalid job Id")
+	err = t.currentSession.KillJob(id)
+	if err != nil {
+		c.Println(err)
+		return
 	}
+	c.Printf("Job %d killed\n", id)
 }
 
 func (t *CLI) listStreams(c *ishell.Context) {
@@ -448,15 +892,287 @@ func (t *CLI) killStream(c *ishell.Context) {
 	}
 	if stream, ok := t.currentSession.registry.streams[uint32(id)]; ok {
 		stream.Close()
-		delete(t.currentSession.jobs, id)
+		t.currentSession.removeJob(id)
 		c.Printf("Stream %d killed\n", id)
 	} else {
 		c.Println("Invalid stream Id")
 	}
 }
 
+// upload and download take [-z gzip|zstd] [-i glob]... [-x glob]... <source> <destination>
+// arguments, the options only apply to directories. Without arguments they ask for the files.
+func (t *CLI) upload(c *ishell.Context) {
+	options, args, err := parseArchiveOptions(c.Args)
+	if err != nil || (len(args) != 0 && len(args) != 2) {
+		c.Println("Usage: upload [-z gzip|zstd] [-i <glob>] [-x <glob>] <local> <remote>")
+		return
+	}
+
+	if len(args) == 0 {
+		args = []string{readParameter(c, "Local file: "), readParameter(c, "Remote file: ")}
+	}
+
+	t.runTransfer(c, TransferUpload, args[0], args[1], options)
+}
+
+func (t *CLI) download(c *ishell.Context) {
+	options, args, err := parseArchiveOptions(c.Args)
+	if err != nil || (len(args) != 0 && len(args) != 2) {
+		c.Println("Usage: download [-z gzip|zstd] [-i <glob>] [-x <glob>] <remote> <local>")
+		return
+	}
+
+	if len(args) == 0 {
+		args = []string{readParameter(c, "Remote file: "), readParameter(c, "Local file: ")}
+	}
+
+	t.runTransfer(c, TransferDownload, args[0], args[1], options)
+}
+
+// runTransfer prints the progress of the transfer until it is done.
+func (t *CLI) runTransfer(c *ishell.Context, transferType string, source string, destination string, options ArchiveOptions) {
+	transfer, err := t.currentSession.NewTransfer(transferType, source, destination, options)
+	if err != nil {
+		c.Println(err)
+		return
+	}
+
+	done := make(chan struct{})
+	printed := make(chan struct{})
+	go func() {
+		printProgress(os.Stdout, transfer, done)
+		close(printed)
+	}()
+
+	err = t.currentSession.RunTransfer(transfer)
+	close(done)
+	<-printed
+
+	if err != nil {
+		c.Println(err)
+		return
+	}
+
+	if result := transfer.Progress().Result; result != nil {
+		c.Printf("%d files %sed, %d bytes\n", result.Files, transferType, result.Size)
+	}
+}
+
+func (t *CLI) listTransfers(c *ishell.Context) {
+	printTransfers(os.Stdout, t.currentSession.Transfers())
+}
+
+func (t *CLI) listFiles(c *ishell.Context) {
+	path := "."
+	if len(c.Args) > 0 {
+		path = c.Args[0]
+	}
+
+	entries, err := t.currentSession.ListFiles(path)
+	if err != nil {
+		c.Println(err)
+		return
+	}
+
+	printFileEntries(os.Stdout, entries)
+}
+
+func (t *CLI) statFile(c *ishell.Context) {
+	if len(c.Args) != 1 {
+		c.Println("Usage: stat <path>")
+		return
+	}
+
+	entry, err := t.currentSession.StatFile(c.Args[0])
+	if err != nil {
+		c.Println(err)
+		return
+	}
+
+	c.Printf("Path: %s\n", entry.Path)
+	c.Printf("Size: %d\n", entry.Size)
+	c.Printf("Mode: %s\n", entry.Mode)
+	c.Printf("Owner: %s:%s\n", entry.Owner, entry.Group)
+	c.Printf("Modified: %s\n", entry.ModTime.Local())
+}
+
+func (t *CLI) makeDir(c *ishell.Context) {
+	recursive, args := parseFlag(c.Args, "-p")
+	if len(args) != 1 {
+		c.Println("Usage: mkdir [-p] <path>")
+		return
+	}
+
+	err := t.currentSession.MakeDir(args[0], recursive)
+	if err != nil {
+		c.Println(err)
+	}
+}
+
+func (t *CLI) removeFile(c *ishell.Context) {
+	recursive, args := parseFlag(c.Args, "-r")
+	if len(args) != 1 {
+		c.Println("Usage: rm [-r] <path>")
+		return
+	}
+
+	err := t.currentSession.RemoveFile(args[0], recursive)
+	if err != nil {
+		c.Println(err)
+	}
+}
+
+func (t *CLI) moveFile(c *ishell.Context) {
+	if len(c.Args) != 2 {
+		c.Println("Usage: mv <source> <destination>")
+		return
+	}
+
+	err := t.currentSession.MoveFile(c.Args[0], c.Args[1])
+	if err != nil {
+		c.Println(err)
+	}
+}
+
+func (t *CLI) chmodFile(c *ishell.Context) {
+	if len(c.Args) != 2 {
+		c.Println("Usage: chmod <octal mode> <path>")
+		return
+	}
+
+	err := t.currentSession.ChmodFile(c.Args[1], c.Args[0])
+	if err != nil {
+		c.Println(err)
+	}
+}
+
+func (t *CLI) touchFile(c *ishell.Context) {
+	if len(c.Args) != 1 {
+		c.Println("Usage: touch <path>")
+		return
+	}
+
+	err := t.currentSession.TouchFile(c.Args[0])
+	if err != nil {
+		c.Println(err)
+	}
+}
+
+func (t *CLI) printWorkingDirectory(c *ishell.Context) {
+	cwd, err := t.currentSession.GetWorkingDirectory()
+	if err != nil {
+		c.Println(err)
+		return
+	}
+	c.Println(cwd)
+}
+
+func (t *CLI) changeDirectory(c *ishell.Context) {
+	if len(c.Args) != 1 {
+		c.Println("Usage: cd <path>")
+		return
+	}
+
+	err := t.currentSession.ChangeDirectory(c.Args[0])
+	if err != nil {
+		c.Println(err)
+	}
+}
+
+// setenv [<name> <value>]
+func (t *CLI) setEnv(c *ishell.Context) {
+	if len(c.Args) == 0 {
+		_, env := t.currentSession.Environment()
+		printEnvironment(os.Stdout, env)
+		return
+	}
+
+	if len(c.Args) != 2 {
+		c.Println("Usage: setenv [<name> <value>]")
+		return
+	}
+	t.currentSession.SetEnv(c.Args[0], c.Args[1])
+}
+
+func (t *CLI) unsetEnv(c *ishell.Context) {
+	if len(c.Args) != 1 {
+		c.Println("Usage: unsetenv <name>")
+		return
+	}
+	t.currentSession.UnsetEnv(c.Args[0])
+}
+
+func (t *CLI) listProcesses(c *ishell.Context) {
+	processes, err := t.currentSession.ListProcesses()
+	if _, ok := err.(*UnsupportedError); ok {
+		t.runCommand(&Execute{
+			writer: os.Stdout,
+			errorWriter: os.Stderr,
+			command: t.server.osCommands[t.currentSession.Os]["ps"],
+		})
+		return
+	}
+	if err != nil {
+		c.Println(err)
+		return
+	}
+
+	printProcesses(os.Stdout, processes)
+}
+
+func (t *CLI) killProcess(c *ishell.Context) {
+	if len(c.Args) != 1 {
+		c.Println("Usage: kill <pid>")
+		return
+	}
+
+	pid, err := strconv.Atoi(c.Args[0])
+	if err != nil {
+		c.Println("Invalid process Id")
+		return
+	}
+
+	err = t.currentSession.KillProcess(pid)
+	if err != nil {
+		c.Println(err)
+		return
+	}
+	c.Printf("Process %d killed\n", pid)
+}
+
+func (t *CLI) listConnections(c *ishell.Context) {
+	connections, err := t.currentSession.ListConnections()
+	if _, ok := err.(*UnsupportedError); ok {
+		t.runCommand(&Execute{
+			writer: os.Stdout,
+			errorWriter: os.Stderr,
+			command: t.server.osCommands[t.currentSession.Os]["netstat"],
+		})
+		return
+	}
+	if err != nil {
+		c.Println(err)
+		return
+	}
+
+	printConnections(os.Stdout, connections)
+}
+
+func (t *CLI) listInterfaces(c *ishell.Context) {
+	interfaces, err := t.currentSession.ListInterfaces()
+	if err != nil {
+		c.Println(err)
+		return
+	}
+
+	printInterfaces(os.Stdout, interfaces)
+}
+
 func (t *CLI) runCommand(command Command) {
-	t.currentSession.RunCommand(command)
+	err := t.currentSession.RunCommand(command)
+	if err != nil {
+		t.shell.Println(err)
+	}
 }
 
 func (t *CLI) generateAgent(c *ishell.Context) {
@@ -465,9 +1181,28 @@ func (t *CLI) generateAgent(c *ishell.Context) {
 	arch := readParameter(c, "Arch: ")
 	host := readParameter(c, "Host: ")
 
-	agentContent, err := t.server.GenerateAgent(os, arch, host, readParameter(c, "HTTP proxy: "), readParameter(c, "HTTPS proxy: "), readParameter(c, "Proxy username: "), readParameter(c, "Proxy password: "), t.server.pubKeyHash)
+	httpProxy := readParameter(c, "HTTP proxy: ")
+	httpsProxy := readParameter(c, "HTTPS proxy: ")
+	proxyUsername := readParameter(c, "Proxy username: ")
+	proxyPassword := readParameter(c, "Proxy password: ")
+
+	reconnect := t.server.config.ReconnectPolicy()
+	reconnect.Interval = readIntParameter(c, "Reconnect interval in seconds", reconnect.Interval)
+	reconnect.MaxInterval = readIntParameter(c, "Maximum reconnect interval in seconds", reconnect.MaxInterval)
+	reconnect.MaxRetries = readIntParameter(c, "Maximum retries, 0 for none", reconnect.MaxRetries)
+
+	killDate := readDefaultParameter(c, "Kill date (YYYY-MM-DD [HH:MM])", t.server.config.Agent.KillDate)
+	operatingHours := readDefaultParameter(c, "Operating hours (HH:MM-HH:MM)", t.server.config.Agent.OperatingHours)
+	limits, err := ParseAgentLimits(killDate, operatingHours)
+	if err != nil {
+		c.Println(err)
+		return
+	}
+
+	build, agentContent, err := t.server.GenerateAgent(os, arch, host, httpProxy, httpsProxy, proxyUsername, proxyPassword, t.server.PinnedKeys(), reconnect, limits)
 	if err != nil {
 		log.Printf("ERROR %s", err)
+		c.Println(err)
 		return
 	}
 
@@ -475,8 +1210,15 @@ func (t *CLI) generateAgent(c *ishell.Context) {
 	err = ioutil.WriteFile("./share/" + filename, agentContent, 0644)
 	if err != nil {
 		log.Printf("ERROR %s", err)
+		c.Println(err)
 		return
 	}
+
+	err = t.server.builds.AddDelivery(build.Id, "share/" + filename)
+	if err != nil {
+		log.Printf("ERROR %s", err)
+	}
+	c.Printf("Generated agent %s, SHA-256 %s\n", build.Id, build.Sha256)
 	c.Printf("Generated agent URL: https://" + host + "/" + t.server.httpMagic + "/" + filename)
 }
 
@@ -492,6 +1234,10 @@ func (t *CLI) printInfo(c *ishell.Context) {
 		c.Printf("API listener: %s\n", t.server.config.Api.Addr)
 	}
 	c.Printf("HTTP magic: %s\n", t.server.httpMagic)
+	c.Printf("Agent templates: %s\n", strings.Join(AgentTemplates(), " "))
+	if scope := t.server.config.Scope; scope.Restricted() {
+		c.Printf("Scope: CIDRs %s, hosts %s, ports %s\n", strings.Join(scope.CIDRs, " "), strings.Join(scope.Hosts, " "), strings.Join(scope.Ports, " "))
+	}
 }
 
 /* Session listener */
@@ -505,5 +1251,14 @@ func (t *CLI) CloseSession(session *Session) {
 		t.currentSession = nil
 		t.registerServerCommands()
 	}
-	t.shell.Printf("Session %d - %s closed\n", session.Id, session.String())
+	t.shell.Printf("Session %d - %s closed: %s\n", session.Id, session.String(), session.CloseReason())
+}
+
+func (t *CLI) DisconnectSession(session *Session) {
+	_, reason := session.Disconnected()
+	t.shell.Printf("Session %d - %s disconnected: %s\n", session.Id, session.String(), reason)
+}
+
+func (t *CLI) ReconnectSession(session *Session) {
+	t.shell.Printf("Session %d - %s reconnected\n", session.Id, session.String())
 }
\ No newline at end of file
@@ -0,0 +1,163 @@
+package gomet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"time"
+)
+
+const (
+	caCertFile = "config/ca.crt"
+	caKeyFile  = "config/ca.key"
+)
+
+// certificateAuthority issues a client certificate to each generated agent,
+// the listener only accepts sessions from agents presenting one.
+type certificateAuthority struct {
+	cert *x509.Certificate
+	key *ecdsa.PrivateKey
+}
+
+// loadCertificateAuthority loads the internal CA, created the first time.
+func loadCertificateAuthority() (*certificateAuthority, error) {
+	certPem, err := ioutil.ReadFile(caCertFile)
+	if os.IsNotExist(err) {
+		return createCertificateAuthority()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keyPem, err := ioutil.ReadFile(caKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPem)
+	keyBlock, _ := pem.Decode(keyPem)
+	if certBlock == nil || keyBlock == nil {
+		return nil, errors.New("Invalid CA certificate or key")
+	}
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &certificateAuthority{cert: cert, key: key}, nil
+}
+
+func createCertificateAuthority() (*certificateAuthority, error) {
+	log.Println("Creating the agents CA")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{CommonName: "GoMet agents CA"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().AddDate(10, 0, 0),
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(caKeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(caCertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &certificateAuthority{cert: cert, key: key}, nil
+}
+
+// pool returns the CA to verify the agents.
+func (c *certificateAuthority) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	return pool
+}
+
+// issue returns a client certificate and its key, PEM encoded, for the
+// build. It expires at notAfter, in 10 years when zero.
+func (c *certificateAuthority) issue(buildId string, notAfter time.Time) ([]byte, []byte, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	if notAfter.IsZero() || notAfter.After(c.cert.NotAfter) {
+		notAfter = c.cert.NotAfter
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{CommonName: buildId},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: notAfter,
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, c.cert, &key.PublicKey, c.key)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPem, keyPem, serial.Text(16), nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
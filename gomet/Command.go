@@ -1,57 +1,163 @@
 package gomet
 
 import (
-	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/xtaci/smux"
+	"hash"
 	"io"
 	"log"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Command interface {
 	IsJob() bool
-	GetRemoteCommand() string
-	Start(session *smux.Session, registry *Registry, logger *LogWriter)
+	GetRequest() *Request
+	Start(call *Call, registry *Registry, logger *LogWriter)
 	Stop()
 	String() string
 }
 
+// scopeChecker is implemented by the commands reaching targets, RunCommand
+// refuses them when they are out of scope.
+type scopeChecker interface {
+	checkScope(scope *Scope) error
+}
+
 
 // Execute command
 // ---------------
 
+// Execute runs a command on the agent. The agent kills the process group
+// of the command after timeout, or when the command is canceled.
 type Execute struct {
 	writer io.Writer
+	errorWriter io.Writer
 	command string
-	stream *smux.Stream
+	timeout time.Duration
+	streams []*smux.Stream
+	// outputLock guards streams and the writes of the stdout and stderr streams
+	outputLock sync.Mutex
+	call *Call
+	callLock sync.Mutex
+	result *ExecuteResult
+	err error
+}
+
+// lockedWriter serializes the writes of the streams sharing a writer.
+type lockedWriter struct {
+	lock *sync.Mutex
+	writer io.Writer
 }
 
-func (e *Execute) GetRemoteCommand() string {
-	return "0\n" + e.command + "\n"
+func (w *lockedWriter) Write(data []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.writer.Write(data)
 }
 
-func (e *Execute) Start(session *smux.Session, registry *Registry, logger *LogWriter) {
+func (e *Execute) GetRequest() *Request {
+	return &Request{
+		Type: "execute",
+		Params: CommandParams{
+			Command: e.command,
+			Timeout: int((e.timeout + time.Second - 1) / time.Second),
+		},
+	}
+}
 
-	e.stream = acceptNewStream(session)
+func (e *Execute) Start(call *Call, registry *Registry, logger *LogWriter) {
 
-	if e.stream == nil {
-		return
+	log.Printf("Execute command %s", e.command)
+
+	e.callLock.Lock()
+	e.call = call
+	e.callLock.Unlock()
+
+	errorWriter := e.errorWriter
+	if errorWriter == nil {
+		errorWriter = e.writer
 	}
 
-	defer e.stream.Close()
+	var wg sync.WaitGroup
 
-	log.Printf("Execute command %s", e.command)
+	for {
+		stream, name, err := call.AcceptNamedStream()
+		if err != nil {
+			break
+		}
+
+		e.outputLock.Lock()
+		e.streams = append(e.streams, stream)
+		e.outputLock.Unlock()
+
+		writer := e.writer
+		if name == "stderr" {
+			writer = errorWriter
+		}
+
+		data := call.DataStream(stream)
+		output := &lockedWriter{lock: &e.outputLock, writer: io.MultiWriter(writer, logger)}
+
+		wg.Add(1)
+		go func() {
+			defer data.Close()
+			io.Copy(output, data)
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+
+	var reply *Message
+	reply, e.err = call.Wait()
+	if e.err != nil {
+		reportError(errorWriter, e.err)
+		return
+	}
+
+	e.result = &ExecuteResult{}
+	e.err = reply.Decode(e.result)
+	if e.err != nil {
+		reportError(errorWriter, e.err)
+		return
+	}
 
-	io.Copy(io.MultiWriter(e.writer, logger), e.stream)
+	if e.result.Canceled {
+		logger.Logger.Printf("Canceled, exit code %d", e.result.ExitCode)
+	} else if e.result.TimedOut {
+		logger.Logger.Printf("Timed out after %s, exit code %d", e.timeout, e.result.ExitCode)
+	} else {
+		logger.Logger.Printf("Exit code %d", e.result.ExitCode)
+	}
 
 	log.Println("Done")
 }
 
+// Cancel asks the agent to kill the command.
+func (e *Execute) Cancel() {
+	e.callLock.Lock()
+	defer e.callLock.Unlock()
+
+	if e.call != nil {
+		e.call.Cancel()
+	}
+}
+
 func (e *Execute) Stop() {
-	if e.stream != nil {
-		e.stream.Close()
+	e.outputLock.Lock()
+	defer e.outputLock.Unlock()
+
+	for _, stream := range e.streams {
+		stream.Close()
 	}
 }
 
@@ -67,31 +173,116 @@ func (e *Execute) String() string {
 // Download command
 // ----------------
 
+// Download writes the remote file to writer, or to localFilename when set.
+// In that case data goes to <localFilename>.part, which is resumed from
+// its current size and renamed once the SHA-256 of the file is verified.
 type Download struct {
 	writer io.Writer
+	localFilename string
 	remoteFilename string
+	offset int64
+	sum hash.Hash
+	transfer *Transfer
 	stream *smux.Stream
+	result *TransferResult
+	err error
 }
 
-func (d *Download) GetRemoteCommand() string {
-	return "1\n" + d.remoteFilename + "\n"
+func (d *Download) GetRequest() *Request {
+	return &Request{
+		Type: "download",
+		Params: TransferParams{Path: d.remoteFilename, Offset: d.offset},
+	}
 }
 
-func (d *Download) Start(session *smux.Session, registry *Registry, logger *LogWriter) {
+func (d *Download) Start(call *Call, registry *Registry, logger *LogWriter) {
 
-	d.stream = acceptNewStream(session)
-
-	if d.stream == nil {
+	d.err = d.download(call, logger)
+	if d.err != nil {
+		log.Printf("ERROR %s", d.err)
 		return
 	}
 
-	defer d.stream.Close()
+	log.Println("Done")
+}
 
-	log.Printf("Download file %s", d.remoteFilename)
+func (d *Download) download(call *Call, logger *LogWriter) error {
 
-	io.Copy(io.MultiWriter(d.writer, logger), d.stream)
+	var err error
+	d.stream, err = call.AcceptStream()
+	if err != nil {
+		return err
+	}
 
-	log.Println("Done")
+	stream := call.DataStream(d.stream)
+	defer stream.Close()
+
+	header, err := readFrame(stream)
+	if err != nil {
+		return err
+	}
+
+	var info TransferInfo
+	err = header.Decode(&info)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Download file %s from %d/%d", d.remoteFilename, info.Offset, info.Size)
+
+	if d.sum == nil {
+		d.sum = sha256.New()
+	}
+
+	writer := d.writer
+	var file *os.File
+	if d.localFilename != "" {
+		file, err = os.OpenFile(d.localFilename + ".part", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer = file
+	} else {
+		writer = io.MultiWriter(writer, logger)
+	}
+
+	if d.transfer != nil {
+		d.transfer.start(info.Size, info.Offset)
+		writer = io.MultiWriter(writer, d.transfer)
+	}
+
+	_, err = io.Copy(io.MultiWriter(writer, d.sum), &chunkReader{reader: stream})
+	if err != nil {
+		return err
+	}
+
+	reply, err := call.Wait()
+	if err != nil {
+		return err
+	}
+
+	d.result = &TransferResult{}
+	err = reply.Decode(d.result)
+	if err != nil {
+		return err
+	}
+
+	if d.result.Sha256 != hex.EncodeToString(d.sum.Sum(nil)) {
+		if file != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+		return errors.New("Integrity check failed")
+	}
+
+	logger.Logger.Printf("Downloaded %s, %d bytes, sha256 %s", d.remoteFilename, d.result.Size, d.result.Sha256)
+
+	if file != nil {
+		file.Close()
+		return os.Rename(file.Name(), d.localFilename)
+	}
+	return nil
 }
 
 func (d *Download) Stop() {
@@ -115,28 +306,82 @@ func (e *Download) String() string {
 type Upload struct {
 	reader io.Reader
 	remoteFilename string
+	offset int64
+	size int64
+	sha256 string
+	transfer *Transfer
 	stream *smux.Stream
+	result *TransferResult
+	err error
+}
+
+func (u *Upload) GetRequest() *Request {
+	return &Request{
+		Type: "upload",
+		Params: TransferParams{
+			Path: u.remoteFilename,
+			Offset: u.offset,
+			Size: u.size,
+			Sha256: u.sha256,
+		},
+	}
 }
 
-func (u *Upload) GetRemoteCommand() string {
-	return "2\n" + u.remoteFilename + "\n"
+func (u *Upload) Start(call *Call, registry *Registry, logger *LogWriter) {
+
+	u.err = u.upload(call, logger)
+	if u.err != nil {
+		log.Printf("ERROR %s", u.err)
+		return
+	}
+
+	log.Println("Done")
 }
 
-func (u *Upload) Start(session *smux.Session, registry *Registry, logger *LogWriter) {
+func (u *Upload) upload(call *Call, logger *LogWriter) error {
 
-	u.stream = acceptNewStream(session)
+	var err error
+	u.stream, err = call.AcceptStream()
+	if err != nil {
+		return err
+	}
 
-	if u.stream == nil {
-		return
+	stream := call.DataStream(u.stream)
+	defer stream.Close()
+
+	log.Printf("Upload file %s from %d/%d", u.remoteFilename, u.offset, u.size)
+
+	chunks := &chunkWriter{writer: stream}
+
+	reader := u.reader
+	if u.transfer != nil {
+		u.transfer.start(u.size, u.offset)
+		reader = io.TeeReader(reader, u.transfer)
 	}
 
-	defer u.stream.Close()
+	_, err = io.Copy(chunks, reader)
+	if err != nil {
+		return err
+	}
 
-	log.Printf("Upload file %s", u.remoteFilename)
+	err = chunks.Close()
+	if err != nil {
+		return err
+	}
 
-	io.Copy(io.MultiWriter(u.stream, logger), u.reader)
+	reply, err := call.Wait()
+	if err != nil {
+		return err
+	}
 
-	log.Println("Done")
+	u.result = &TransferResult{}
+	err = reply.Decode(u.result)
+	if err != nil {
+		return err
+	}
+
+	logger.Logger.Printf("Uploaded %s, %d bytes, sha256 %s", u.remoteFilename, u.result.Size, u.result.Sha256)
+	return nil
 }
 
 func (u *Upload) Stop() {
@@ -154,55 +399,309 @@ func (e *Upload) String() string {
 }
 
 
+// Download directory command
+// --------------------------
+
+type DownloadArchive struct {
+	localDirectory string
+	remoteDirectory string
+	options ArchiveOptions
+	transfer *Transfer
+	stream *smux.Stream
+	result *ArchiveResult
+	err error
+}
+
+func (d *DownloadArchive) GetRequest() *Request {
+	return &Request{
+		Type: "archive.download",
+		Params: ArchiveParams{
+			Path: d.remoteDirectory,
+			Compression: d.options.Compression,
+			Include: d.options.Include,
+			Exclude: d.options.Exclude,
+		},
+	}
+}
+
+func (d *DownloadArchive) Start(call *Call, registry *Registry, logger *LogWriter) {
+
+	d.err = d.download(call)
+	if d.err != nil {
+		log.Printf("ERROR %s", d.err)
+		return
+	}
+
+	logger.Logger.Printf("Downloaded %s, %d files, %d bytes", d.remoteDirectory, d.result.Files, d.result.Size)
+	log.Println("Done")
+}
+
+func (d *DownloadArchive) download(call *Call) error {
+
+	var err error
+	d.stream, err = call.AcceptStream()
+	if err != nil {
+		return err
+	}
+
+	defer d.stream.Close()
+
+	log.Printf("Download directory %s to %s", d.remoteDirectory, d.localDirectory)
+
+	var source io.Reader = d.stream
+	if d.transfer != nil {
+		d.transfer.start(0, 0)
+		source = io.TeeReader(source, d.transfer)
+	}
+
+	reader, err := newDecompressReader(source, d.options.Compression)
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	d.result, err = extractArchive(reader, d.localDirectory)
+	if err != nil {
+		return err
+	}
+
+	_, err = call.Wait()
+	return err
+}
+
+func (d *DownloadArchive) Stop() {
+	if d.stream != nil {
+		d.stream.Close()
+	}
+}
+
+func (d *DownloadArchive) IsJob() bool {
+	return false
+}
+
+func (d *DownloadArchive) String() string {
+	return "Downloading directory " + d.remoteDirectory
+}
+
+
+// Upload directory command
+// ------------------------
+
+type UploadArchive struct {
+	localDirectory string
+	remoteDirectory string
+	options ArchiveOptions
+	transfer *Transfer
+	stream *smux.Stream
+	result *ArchiveResult
+	err error
+}
+
+func (u *UploadArchive) GetRequest() *Request {
+	return &Request{
+		Type: "archive.upload",
+		Params: ArchiveParams{
+			Path: u.remoteDirectory,
+			Compression: u.options.Compression,
+		},
+	}
+}
+
+func (u *UploadArchive) Start(call *Call, registry *Registry, logger *LogWriter) {
+
+	u.err = u.upload(call)
+	if u.err != nil {
+		log.Printf("ERROR %s", u.err)
+		return
+	}
+
+	logger.Logger.Printf("Uploaded %s, %d files, %d bytes", u.localDirectory, u.result.Files, u.result.Size)
+	log.Println("Done")
+}
+
+func (u *UploadArchive) upload(call *Call) error {
+
+	var err error
+	u.stream, err = call.AcceptStream()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Upload directory %s to %s", u.localDirectory, u.remoteDirectory)
+
+	var destination io.Writer = u.stream
+	if u.transfer != nil {
+		u.transfer.start(0, 0)
+		destination = io.MultiWriter(destination, u.transfer)
+	}
+
+	writer, err := newCompressWriter(destination, u.options.Compression)
+	if err != nil {
+		u.stream.Close()
+		return err
+	}
+
+	_, err = writeArchive(writer, u.localDirectory, u.options.Include, u.options.Exclude)
+	if err == nil {
+		err = writer.Close()
+	}
+	u.stream.Close()
+	if err != nil {
+		return err
+	}
+
+	reply, err := call.Wait()
+	if err != nil {
+		return err
+	}
+
+	u.result = &ArchiveResult{}
+	return reply.Decode(u.result)
+}
+
+func (u *UploadArchive) Stop() {
+	if u.stream != nil {
+		u.stream.Close()
+	}
+}
+
+func (u *UploadArchive) IsJob() bool {
+	return false
+}
+
+func (u *UploadArchive) String() string {
+	return "Uploading directory " + u.localDirectory
+}
+
+
 // Shell command
 // -------------
 
+// Shell is an interactive shell on the agent. A named shell keeps running
+// when we detach with Ctrl-], an unnamed one is killed.
 type Shell struct {
 	writer io.Writer
 	reader io.Reader
+	name string
+	terminal *localTerminal
 	stream *smux.Stream
+	control *smux.Stream
+	detached int32
+	result *ShellResult
+	err error
+}
+
+// Ctrl-]
+const detachKey = 0x1d
+
+func (s *Shell) GetRequest() *Request {
+	params := ShellParams{Name: s.name, Term: os.Getenv("TERM")}
+	if s.terminal != nil {
+		size, err := s.terminal.size()
+		if err == nil {
+			params.Rows = size.Rows
+			params.Cols = size.Cols
+		}
+	}
+	return &Request{Type: "shell", Params: params}
 }
 
-func (s *Shell) GetRemoteCommand() string {
-	return "3\n"
-}
-
-func (s *Shell) Start(session *smux.Session, registry *Registry, logger *LogWriter) {
+func (s *Shell) Start(call *Call, registry *Registry, logger *LogWriter) {
 
-	s.stream = acceptNewStream(session)
-	if s.stream == nil {
-		return
+	// The agent opens the shell stream and a control stream for resizes
+	for s.stream == nil || s.control == nil {
+		stream, name, err := call.AcceptNamedStream()
+		if err != nil {
+			s.err = err
+			reportError(s.writer, err)
+			return
+		}
+		if name == "control" {
+			s.control = stream
+		} else {
+			s.stream = stream
+		}
 	}
 
-	defer s.stream.Close()
+	stream := call.DataStream(s.stream)
+	defer stream.Close()
 
 	log.Printf("New shell")
 
+	if s.terminal != nil {
+		err := s.terminal.makeRaw()
+		if err != nil {
+			log.Printf("ERROR %s", err)
+		}
+		defer s.terminal.restore()
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go watchResize(s.terminal, stop, s.resize)
+	}
+
+	reader := s.reader
+	if s.name != "" {
+		reader = &detachReader{reader: reader, detach: s.detach}
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go func() {
-		io.Copy(io.MultiWriter(s.stream, logger), s.reader)
+		io.Copy(io.MultiWriter(stream, logger), reader)
 		wg.Done()
 	}()
 
 	go func() {
-		io.Copy(io.MultiWriter(s.writer, logger), s.stream)
+		io.Copy(io.MultiWriter(s.writer, logger), stream)
+		if s.terminal != nil {
+			s.terminal.restore()
+		}
 		wg.Done()
-		fmt.Printf("Press \"Enter\" to close")
+		if atomic.LoadInt32(&s.detached) == 0 {
+			fmt.Printf("Press \"Enter\" to close")
+		}
 	}()
 
-	s.stream.Write([]byte("\n"))
+	stream.Write([]byte("\n"))
 
 	wg.Wait()
 
+	reply, err := call.Wait()
+	if err != nil {
+		s.err = err
+		return
+	}
+
+	s.result = &ShellResult{}
+	s.err = reply.Decode(s.result)
+
 	log.Println("Done")
 }
 
+// detach closes the shell stream, the agent keeps the shell running.
+func (s *Shell) detach() {
+	atomic.StoreInt32(&s.detached, 1)
+	s.stream.Close()
+}
+
+func (s *Shell) resize(size WindowSize) {
+	data, err := json.Marshal(size)
+	if err != nil {
+		return
+	}
+	writeFrame(s.control, &Message{Type: "resize", Data: data})
+}
+
 func (s *Shell) Stop() {
 	if s.stream != nil {
 		s.stream.Close()
 	}
+	if s.control != nil {
+		s.control.Close()
+	}
 }
 
 func (e *Shell) IsJob() bool {
@@ -210,9 +709,33 @@ func (e *Shell) IsJob() bool {
 }
 
 func (e *Shell) String() string {
+	if e.name != "" {
+		return "Interactive shell " + e.name
+	}
 	return "Interactive shell"
 }
 
+// detachReader ends the input of a shell when the detach key is typed.
+type detachReader struct {
+	reader io.Reader
+	detach func()
+	detached bool
+}
+
+func (d *detachReader) Read(data []byte) (int, error) {
+	if d.detached {
+		d.detach()
+		return 0, io.EOF
+	}
+
+	n, err := d.reader.Read(data)
+	if i := bytes.IndexByte(data[:n], detachKey); i >= 0 {
+		d.detached = true
+		return i, nil
+	}
+	return n, err
+}
+
 
 // Listen command
 // --------------
@@ -220,42 +743,24 @@ func (e *Shell) String() string {
 type Listen struct {
 	localAddress string
 	remoteAddress string
-	stream *smux.Stream
+	call *Call
 }
 
-func (l *Listen) GetRemoteCommand() string {
-	return "4\n" + l.remoteAddress + "\n"
+func (l *Listen) GetRequest() *Request {
+	return &Request{
+		Type: "listen",
+		Params: AddressParams{Address: l.remoteAddress},
+	}
 }
 
-func (l *Listen) Start(session *smux.Session, registry *Registry, logger *LogWriter) {
+func (l *Listen) Start(call *Call, registry *Registry, logger *LogWriter) {
 
-	l.stream = acceptNewStream(session)
-	if l.stream == nil {
-		return
-	}
+	l.call = call
 
 	go func() {
-
-		defer l.stream.Close()
-
-		reader := bufio.NewReader(l.stream)
-
 		for {
 			log.Println("Wait for remote connection...")
-			_, _, err := reader.ReadLine()
-			if err != nil {
-				log.Printf("ERROR %s", err)
-				break
-			}
-
-			_, err = l.stream.Write([]byte("OK\n"))
-			if err != nil {
-				log.Printf("ERROR %s", err)
-				break
-			}
-
-			log.Println("Open stream")
-			listenStream, err := session.OpenStream()
+			listenStream, err := call.AcceptStream()
 			if err != nil {
 				log.Printf("ERROR %s", err)
 				break
@@ -275,12 +780,16 @@ func (l *Listen) Start(session *smux.Session, registry *Registry, logger *LogWri
 }
 
 func (l *Listen) Stop() {
-	if l.stream != nil {
-		log.Println("Closing command stream")
-		l.stream.Close()
+	if l.call != nil {
+		log.Println("Cancel remote listener")
+		l.call.Cancel()
 	}
 }
 
+func (l *Listen) checkScope(scope *Scope) error {
+	return scope.CheckListen(l.remoteAddress)
+}
+
 func (l *Listen) IsJob() bool {
 	return true
 }
@@ -300,11 +809,11 @@ type Connect struct {
 	session *Session
 }
 
-func (l *Connect) GetRemoteCommand() string {
-	return ""
+func (l *Connect) GetRequest() *Request {
+	return nil
 }
 
-func (l *Connect) Start(session *smux.Session, registry *Registry, logger *LogWriter) {
+func (l *Connect) Start(call *Call, registry *Registry, logger *LogWriter) {
 
 	go func() {
 		var err error
@@ -335,6 +844,10 @@ func (l *Connect) Stop() {
 	}
 }
 
+func (l *Connect) checkScope(scope *Scope) error {
+	return scope.CheckAddress(l.remoteAddress)
+}
+
 func (l *Connect) IsJob() bool {
 	return true
 }
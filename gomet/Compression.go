@@ -0,0 +1,283 @@
+package gomet
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"text/tabwriter"
+)
+
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// Requests whose streams can be compressed
+var compressibleStreams = []string{"execute", "download", "upload", "shell"}
+
+// Requests whose streams are flushed on each write
+var interactiveStreams = []string{"execute", "shell"}
+
+type CompressionStats struct {
+	Stream    string  `json:"stream"`
+	Algorithm string  `json:"algorithm"`
+	Raw       int64   `json:"raw"`
+	Wire      int64   `json:"wire"`
+	Ratio     float64 `json:"ratio"`
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func newCompressWriter(writer io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionNone:
+		return nopWriteCloser{writer}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(writer), nil
+	case CompressionZstd:
+		return zstd.NewWriter(writer)
+	}
+	return nil, errors.New("Unknown compression " + compression)
+}
+
+func newDecompressReader(reader io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionNone:
+		return ioutil.NopCloser(reader), nil
+	case CompressionGzip:
+		return gzip.NewReader(reader)
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, errors.New("Unknown compression " + compression)
+}
+
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newFlushWriter(writer io.Writer, compression string) (flushWriteCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewWriter(writer), nil
+	case CompressionZstd:
+		return zstd.NewWriter(writer)
+	}
+	return nil, errors.New("Unknown compression " + compression)
+}
+
+// compressedStream compresses what is written to a stream and decompresses
+// what is read from it. Writes to interactive streams are flushed at once,
+// bulk streams are flushed by Flush and Close.
+type compressedStream struct {
+	stream io.ReadWriteCloser
+	compression string
+	interactive bool
+	reader io.ReadCloser
+	writer flushWriteCloser
+	counter *ByteCounter
+}
+
+func (c *compressedStream) Read(data []byte) (int, error) {
+	if c.reader == nil {
+		var err error
+		c.reader, err = newDecompressReader(&countingReader{reader: c.stream, count: &c.counter.Wire}, c.compression)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := c.reader.Read(data)
+	atomic.AddInt64(&c.counter.Raw, int64(n))
+	return n, err
+}
+
+func (c *compressedStream) Write(data []byte) (int, error) {
+	if c.writer == nil {
+		var err error
+		c.writer, err = newFlushWriter(&countingWriter{writer: c.stream, count: &c.counter.Wire}, c.compression)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := c.writer.Write(data)
+	atomic.AddInt64(&c.counter.Raw, int64(n))
+	if err != nil || !c.interactive {
+		return n, err
+	}
+	return n, c.writer.Flush()
+}
+
+func (c *compressedStream) Flush() error {
+	if c.writer == nil {
+		return nil
+	}
+	return c.writer.Flush()
+}
+
+func (c *compressedStream) Close() error {
+	if c.writer != nil {
+		c.writer.Close()
+	}
+	if c.reader != nil {
+		c.reader.Close()
+	}
+	return c.stream.Close()
+}
+
+// ByteCounter counts the bytes of compressed streams before compression
+// and as sent over the wire.
+type ByteCounter struct {
+	Raw  int64 `json:"raw"`
+	Wire int64 `json:"wire"`
+}
+
+func (b *ByteCounter) Ratio() float64 {
+	wire := atomic.LoadInt64(&b.Wire)
+	if wire == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&b.Raw)) / float64(wire)
+}
+
+type countingReader struct {
+	reader io.Reader
+	count *int64
+}
+
+func (c *countingReader) Read(data []byte) (int, error) {
+	n, err := c.reader.Read(data)
+	atomic.AddInt64(c.count, int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	writer io.Writer
+	count *int64
+}
+
+func (c *countingWriter) Write(data []byte) (int, error) {
+	n, err := c.writer.Write(data)
+	atomic.AddInt64(c.count, int64(n))
+	return n, err
+}
+
+// selectCompression returns the preferred compression if the agent supports it.
+func selectCompression(preferred string, supported []string) string {
+	for _, compression := range supported {
+		if compression == preferred {
+			return compression
+		}
+	}
+	return CompressionNone
+}
+
+func newDataStream(stream io.ReadWriteCloser, compression string, counter *ByteCounter, interactive bool) io.ReadWriteCloser {
+	if compression == CompressionNone {
+		return stream
+	}
+	return &compressedStream{stream: stream, compression: compression, counter: counter, interactive: interactive}
+}
+
+func isInteractiveStream(requestType string) bool {
+	for _, stream := range interactiveStreams {
+		if stream == requestType {
+			return true
+		}
+	}
+	return false
+}
+
+/* -----------------
+   Session
+  ------------------ */
+
+// SetCompression enables compression for the given stream types, or for
+// all of them when none is given. Use CompressionNone to disable it.
+func (s *Session) SetCompression(algorithm string, streams []string) error {
+	if algorithm != CompressionNone && selectCompression(algorithm, s.Compressions) == CompressionNone {
+		return errors.New("Compression " + algorithm + " not supported by agent")
+	}
+
+	if len(streams) == 0 {
+		streams = compressibleStreams
+	}
+
+	s.compressionLock.Lock()
+	defer s.compressionLock.Unlock()
+
+	for _, stream := range streams {
+		if selectCompression(stream, compressibleStreams) == CompressionNone {
+			return errors.New("Stream " + stream + " can't be compressed")
+		}
+		s.compressions[stream] = algorithm
+	}
+	return nil
+}
+
+func (s *Session) getCompression(stream string) (string, *ByteCounter) {
+	s.compressionLock.Lock()
+	defer s.compressionLock.Unlock()
+
+	compression := s.compressions[stream]
+	if compression == CompressionNone {
+		return compression, nil
+	}
+
+	counter, ok := s.counters[stream]
+	if !ok {
+		counter = &ByteCounter{}
+		s.counters[stream] = counter
+	}
+	return compression, counter
+}
+
+func (s *Session) CompressionStats() []CompressionStats {
+	s.compressionLock.Lock()
+	defer s.compressionLock.Unlock()
+
+	var stats []CompressionStats
+	for _, stream := range compressibleStreams {
+		stat := CompressionStats{
+			Stream: stream,
+			Algorithm: s.compressions[stream],
+		}
+		if counter, ok := s.counters[stream]; ok {
+			stat.Raw = atomic.LoadInt64(&counter.Raw)
+			stat.Wire = atomic.LoadInt64(&counter.Wire)
+			stat.Ratio = counter.Ratio()
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+func printCompressionStats(writer io.Writer, stats []CompressionStats) {
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "STREAM\tCOMPRESSION\tRAW\tWIRE\tRATIO")
+	for _, stat := range stats {
+		algorithm := stat.Algorithm
+		if algorithm == CompressionNone {
+			algorithm = "none"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%d\t%d\t%.2f\n", stat.Stream, algorithm, stat.Raw, stat.Wire, stat.Ratio)
+	}
+	table.Flush()
+}
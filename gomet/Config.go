@@ -2,8 +2,10 @@ package gomet
 
 import (
 	"encoding/json"
+	"github.com/xtaci/smux"
 	"log"
 	"os"
+	"time"
 )
 
 type Config struct {
@@ -30,8 +32,104 @@ type Config struct {
 		Addr string `json:"addr"`
 	} `json:"api"`
 
+	Compression struct {
+		Algorithm string `json:"algorithm"`
+		Streams []string `json:"streams"`
+	} `json:"compression"`
+
+	Execute struct {
+		Timeout int `json:"timeout"`
+	} `json:"execute"`
+
+	Keepalive struct {
+		Interval int `json:"interval"`
+		Timeout int `json:"timeout"`
+		Reconnect int `json:"reconnect"`
+	} `json:"keepalive"`
+
+	Scope Scope `json:"scope"`
+
+	Agent struct {
+		Reconnect ReconnectPolicy `json:"reconnect"`
+		KillDate string `json:"killDate"`
+		OperatingHours string `json:"operatingHours"`
+	} `json:"agent"`
+
+}
+
+// ReconnectPolicy is built into the agents. The delay between two connection
+// attempts starts at Interval and doubles after each failure up to
+// MaxInterval, the agent exits after MaxRetries failures in a row, 0 for
+// never. Times are in seconds.
+type ReconnectPolicy struct {
+	Interval int `json:"interval"`
+	MaxInterval int `json:"maxInterval"`
+	MaxRetries int `json:"maxRetries"`
+}
+
+// ReconnectPolicy defaults to an attempt every minute, without backoff nor limit.
+func (c *Config) ReconnectPolicy() ReconnectPolicy {
+	policy := c.Agent.Reconnect
+	if policy.Interval <= 0 {
+		policy.Interval = 60
+	}
+	if policy.MaxInterval < policy.Interval {
+		policy.MaxInterval = policy.Interval
+	}
+	if policy.MaxRetries < 0 {
+		policy.MaxRetries = 0
+	}
+	return policy
+}
+
+
+// ExecuteTimeout is the default timeout of execute, 0 for none.
+func (c *Config) ExecuteTimeout() time.Duration {
+	return time.Duration(c.Execute.Timeout) * time.Second
+}
+
+// Keepalive defaults to a ping every 10 seconds and a 30 seconds timeout.
+func (c *Config) KeepaliveInterval() time.Duration {
+	if c.Keepalive.Interval <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(c.Keepalive.Interval) * time.Second
+}
+
+func (c *Config) KeepaliveTimeout() time.Duration {
+	if c.Keepalive.Timeout <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.Keepalive.Timeout) * time.Second
+}
+
+// ReconnectWindow is how long a disconnected session waits for its agent, 10 minutes by default.
+func (c *Config) ReconnectWindow() time.Duration {
+	if c.Keepalive.Reconnect <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(c.Keepalive.Reconnect) * time.Second
+}
+
+// AgentLimits returns the default kill date and operating hours of the agents.
+func (c *Config) AgentLimits() (AgentLimits, error) {
+	return ParseAgentLimits(c.Agent.KillDate, c.Agent.OperatingHours)
 }
 
+// smuxConfig makes the smux keepalive match ours so it doesn't close the
+// connection first.
+func (c *Config) smuxConfig() *smux.Config {
+	config := smux.DefaultConfig()
+	config.KeepAliveInterval = c.KeepaliveInterval()
+	config.KeepAliveTimeout = c.KeepaliveTimeout() + c.KeepaliveInterval()
+
+	err := smux.VerifyConfig(config)
+	if err != nil {
+		log.Printf("ERROR %s", err)
+		return nil
+	}
+	return config
+}
 
 func LoadConfig() (Config, error) {
 
@@ -53,5 +151,10 @@ func LoadConfig() (Config, error) {
 		return config, err
 	}
 
+	err = config.Scope.compile()
+	if err != nil {
+		return config, err
+	}
+
 	return config, nil
 }
@@ -0,0 +1,81 @@
+package gomet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+/* -----------------
+   Session environment
+  ------------------ */
+
+// Requests carry the working directory and the environment overrides of
+// the session. The agent resolves relative paths against the directory,
+// execute and shell run in it with the overrides applied.
+
+// ChangeDirectory resolves path on the agent, relative to the current directory.
+func (s *Session) ChangeDirectory(path string) error {
+	entry, err := s.StatFile(path)
+	if err != nil {
+		return err
+	}
+
+	if !entry.IsDir {
+		return errors.New(entry.Path + " is not a directory")
+	}
+
+	s.envLock.Lock()
+	s.workingDirectory = entry.Path
+	s.envLock.Unlock()
+
+	s.logWriter.WriteString("Change directory " + entry.Path)
+	return nil
+}
+
+func (s *Session) SetEnv(name string, value string) {
+	s.envLock.Lock()
+	s.env[name] = &value
+	s.envLock.Unlock()
+}
+
+// UnsetEnv removes the variable from the environment of the commands.
+func (s *Session) UnsetEnv(name string) {
+	s.envLock.Lock()
+	s.env[name] = nil
+	s.envLock.Unlock()
+}
+
+// Environment returns the working directory, empty for the one of the agent,
+// and a copy of the environment overrides.
+func (s *Session) Environment() (string, map[string]*string) {
+	s.envLock.Lock()
+	defer s.envLock.Unlock()
+
+	if len(s.env) == 0 {
+		return s.workingDirectory, nil
+	}
+
+	env := make(map[string]*string, len(s.env))
+	for name, value := range s.env {
+		env[name] = value
+	}
+	return s.workingDirectory, env
+}
+
+func printEnvironment(writer io.Writer, env map[string]*string) {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if env[name] == nil {
+			fmt.Fprintf(writer, "%s (unset)\n", name)
+		} else {
+			fmt.Fprintf(writer, "%s=%s\n", name, *env[name])
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package gomet
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+)
+
+/* -----------------
+   File operations
+  ------------------ */
+
+func (s *Session) GetWorkingDirectory() (string, error) {
+	var result FileParams
+	err := s.Request("fs.getwd", nil, &result)
+	return result.Path, err
+}
+
+func (s *Session) ListFiles(path string) ([]FileEntry, error) {
+	s.logWriter.WriteString("List files " + path)
+
+	var entries []FileEntry
+	err := s.Request("fs.list", FileParams{Path: path}, &entries)
+	return entries, err
+}
+
+func (s *Session) StatFile(path string) (*FileEntry, error) {
+	var entry FileEntry
+	err := s.Request("fs.stat", FileParams{Path: path}, &entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (s *Session) MakeDir(path string, recursive bool) error {
+	s.logWriter.WriteString("Make directory " + path)
+	return s.Request("fs.mkdir", FileParams{Path: path, Recursive: recursive}, nil)
+}
+
+func (s *Session) RemoveFile(path string, recursive bool) error {
+	s.logWriter.WriteString("Remove " + path)
+	return s.Request("fs.remove", FileParams{Path: path, Recursive: recursive}, nil)
+}
+
+func (s *Session) MoveFile(source string, destination string) error {
+	s.logWriter.WriteString("Move " + source + " to " + destination)
+	return s.Request("fs.move", MoveParams{Source: source, Destination: destination}, nil)
+}
+
+func (s *Session) ChmodFile(path string, mode string) error {
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("Invalid mode %s", mode)
+	}
+
+	s.logWriter.WriteString("Change mode of " + path + " to " + mode)
+	return s.Request("fs.chmod", ChmodParams{Path: path, Mode: uint32(value)}, nil)
+}
+
+func (s *Session) TouchFile(path string) error {
+	s.logWriter.WriteString("Touch " + path)
+	return s.Request("fs.touch", FileParams{Path: path}, nil)
+}
+
+func printFileEntries(writer io.Writer, entries []FileEntry) {
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	for _, entry := range entries {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%s\t%s\n",
+			entry.Mode,
+			entry.Owner,
+			entry.Group,
+			entry.Size,
+			entry.ModTime.Local().Format("2006-01-02 15:04"),
+			entry.Name)
+	}
+	table.Flush()
+}
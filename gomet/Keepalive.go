@@ -0,0 +1,83 @@
+package gomet
+
+import (
+	"log"
+	"time"
+)
+
+/* -----------------
+   Keepalive
+  ------------------ */
+
+// keepalive pings the agent every interval and disconnects the session
+// when the agent doesn't answer within the timeout.
+func (s *Session) keepalive() {
+	interval := s.server.config.KeepaliveInterval()
+	timeout := s.server.config.KeepaliveTimeout()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+
+		if disconnected, _ := s.Disconnected(); disconnected {
+			continue
+		}
+
+		_, commandStream := s.connection()
+		_, err := s.Ping(timeout)
+		if err != nil {
+			log.Printf("ERROR session %d: %s", s.Id, err)
+			s.disconnect(commandStream, "No answer to keepalive for " + timeout.String())
+		}
+	}
+}
+
+// Ping returns the round trip time of a request. An error reply still
+// proves the agent is alive.
+func (s *Session) Ping(timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+
+	call, err := s.Send(&Request{Type: "ping"})
+	if err != nil {
+		return 0, err
+	}
+
+	reply, err := call.WaitTimeout(timeout)
+	if reply == nil {
+		return 0, err
+	}
+
+	latency := time.Since(start)
+
+	s.stateLock.Lock()
+	s.latency = latency
+	s.stateLock.Unlock()
+
+	s.seen()
+	return latency, nil
+}
+
+func (s *Session) seen() {
+	s.stateLock.Lock()
+	s.lastSeen = time.Now()
+	s.stateLock.Unlock()
+}
+
+// LastSeen returns when the agent last answered and the latency of the last ping.
+func (s *Session) LastSeen() (time.Time, time.Duration) {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.lastSeen, s.latency
+}
+
+func (s *Session) CloseReason() string {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.closeReason
+}
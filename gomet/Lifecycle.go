@@ -0,0 +1,80 @@
+package gomet
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+/* -----------------
+   Lifecycle
+  ------------------ */
+
+// Disconnect asks the agent to leave, it reconnects after delay or after
+// its reconnect interval when delay is 0. The session waits for it.
+func (s *Session) Disconnect(delay time.Duration) (*LifecycleResult, error) {
+	return s.leave("disconnect", LifecycleParams{Delay: int(delay / time.Second)}, "Disconnected by operator", false)
+}
+
+// Terminate asks the agent process to exit and closes the session.
+func (s *Session) Terminate() (*LifecycleResult, error) {
+	return s.leave("terminate", nil, "Agent terminated", true)
+}
+
+// Uninstall asks the agent to remove its executable and its lockfile then
+// to exit, and closes the session.
+func (s *Session) Uninstall() (*LifecycleResult, error) {
+	return s.leave("uninstall", nil, "Agent uninstalled", true)
+}
+
+// leave sends a lifecycle request, the confirmation of the agent is kept
+// in the session log. The agent then closes the connection, which
+// disconnects the session for reason, or closes it.
+func (s *Session) leave(requestType string, params interface{}, reason string, closeSession bool) (*LifecycleResult, error) {
+	s.logWriter.WriteString("Request " + requestType)
+
+	s.stateLock.Lock()
+	s.leaveReason = reason
+	s.leaveClose = closeSession
+	s.stateLock.Unlock()
+
+	var result LifecycleResult
+	err := s.Request(requestType, params, &result)
+	if err != nil {
+		s.stateLock.Lock()
+		s.leaveReason = ""
+		s.leaveClose = false
+		s.stateLock.Unlock()
+
+		log.Printf("ERROR %s", err)
+		s.logWriter.WriteString("Failed to " + requestType + ": " + err.Error())
+		return nil, err
+	}
+
+	s.logWriter.WriteString("Confirmed " + requestType + ": " + result.String())
+
+	if closeSession {
+		s.server.closeSession(s.Id, reason)
+	}
+	return &result, nil
+}
+
+func (r *LifecycleResult) String() string {
+	result := fmt.Sprintf("pid %d", r.Pid)
+	if r.Executable != "" {
+		result += ", executable " + r.Executable
+	}
+	if len(r.Removed) > 0 {
+		result += ", removed " + strings.Join(r.Removed, ", ")
+	}
+	if len(r.Errors) > 0 {
+		result += ", errors " + strings.Join(r.Errors, ", ")
+	}
+	return result
+}
+
+func printLifecycleResult(writer io.Writer, requestType string, result *LifecycleResult) {
+	fmt.Fprintf(writer, "Agent confirmed %s: %s\n", requestType, result)
+}
@@ -0,0 +1,82 @@
+package gomet
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// AgentLimits are built into the agents. An agent only connects during the
+// operating hours, HH:MM-HH:MM in its local time, and exits at the kill date.
+// Zero values mean no limit.
+type AgentLimits struct {
+	KillDate time.Time
+	OperatingHours string
+}
+
+// ParseAgentLimits reads a kill date, "2006-01-02" for the end of the day
+// or "2006-01-02 15:04" in the local time of the controller.
+func ParseAgentLimits(killDate string, operatingHours string) (AgentLimits, error) {
+	var limits AgentLimits
+	var err error
+
+	killDate = strings.TrimSpace(killDate)
+	if killDate != "" {
+		limits.KillDate, err = time.ParseInLocation("2006-01-02 15:04", killDate, time.Local)
+		if err != nil {
+			limits.KillDate, err = time.ParseInLocation("2006-01-02", killDate, time.Local)
+			if err != nil {
+				return limits, errors.New("Invalid kill date " + killDate)
+			}
+			limits.KillDate = limits.KillDate.AddDate(0, 0, 1)
+		}
+	}
+
+	operatingHours = strings.TrimSpace(operatingHours)
+	if operatingHours != "" {
+		bounds := strings.Split(operatingHours, "-")
+		if len(bounds) != 2 {
+			return limits, errors.New("Invalid operating hours " + operatingHours)
+		}
+		for _, bound := range bounds {
+			_, err = time.Parse("15:04", strings.TrimSpace(bound))
+			if err != nil {
+				return limits, errors.New("Invalid operating hours " + operatingHours)
+			}
+		}
+		if strings.TrimSpace(bounds[0]) == strings.TrimSpace(bounds[1]) {
+			return limits, errors.New("Empty operating hours " + operatingHours)
+		}
+		limits.OperatingHours = operatingHours
+	}
+	return limits, nil
+}
+
+func (l AgentLimits) String() string {
+	result := "no kill date"
+	if !l.KillDate.IsZero() {
+		result = "kill date " + l.KillDate.Local().Format("2006-01-02 15:04")
+	}
+	if l.OperatingHours != "" {
+		result += ", operating hours " + l.OperatingHours
+	}
+	return result
+}
+
+/* -----------------
+   Session
+  ------------------ */
+
+// Expiry describes when the agent of the session exits.
+func (s *Session) Expiry() string {
+	if s.KillDate == nil {
+		return "never"
+	}
+
+	remaining := time.Until(*s.KillDate)
+	expiry := s.KillDate.Local().Format("2006-01-02 15:04")
+	if remaining <= 0 {
+		return expiry + " (expired)"
+	}
+	return expiry + " (in " + remaining.Truncate(time.Minute).String() + ")"
+}
@@ -0,0 +1,82 @@
+package gomet
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+/* -----------------
+   Network
+  ------------------ */
+
+func (s *Session) ListConnections() ([]Connection, error) {
+	var connections []Connection
+	err := s.Request("net.connections", nil, &connections)
+	return connections, err
+}
+
+// ListInterfaces asks the agent for its interfaces and refreshes the ones
+// received during the handshake.
+func (s *Session) ListInterfaces() ([]NetInterface, error) {
+	var interfaces []NetInterface
+	err := s.Request("net.interfaces", nil, &interfaces)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Interfaces = interfaces
+	return interfaces, nil
+}
+
+// Subnets returns the IPv4 networks the agent is directly connected to,
+// loopback and link-local networks excluded.
+func (s *Session) Subnets() []string {
+	var subnets []string
+	for _, iface := range s.Interfaces {
+		for _, address := range iface.Addresses {
+			ip, ipnet, err := net.ParseCIDR(address)
+			if err != nil || ip.To4() == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			subnets = append(subnets, ipnet.String())
+		}
+	}
+	return subnets
+}
+
+func printConnections(writer io.Writer, connections []Connection) {
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "PROTO\tLOCAL ADDRESS\tREMOTE ADDRESS\tSTATE\tUSER\tPID")
+	for _, connection := range connections {
+		protocol := connection.Protocol
+		if connection.Type != "" {
+			protocol += "/" + strings.ToLower(connection.Type)
+		}
+
+		pid := ""
+		if connection.Pid != 0 {
+			pid = strconv.Itoa(connection.Pid)
+		}
+
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			protocol,
+			connection.LocalAddress,
+			connection.RemoteAddress,
+			connection.State,
+			connection.User,
+			pid)
+	}
+	table.Flush()
+}
+
+func printInterfaces(writer io.Writer, interfaces []NetInterface) {
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	for _, iface := range interfaces {
+		fmt.Fprintf(table, "%s\t%s\t%s\n", iface.Name, iface.HardwareAddr, strings.Join(iface.Addresses, ", "))
+	}
+	table.Flush()
+}
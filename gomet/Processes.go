@@ -0,0 +1,41 @@
+package gomet
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+)
+
+/* -----------------
+   Processes
+  ------------------ */
+
+func (s *Session) ListProcesses() ([]Process, error) {
+	var processes []Process
+	err := s.Request("ps.list", nil, &processes)
+	return processes, err
+}
+
+func (s *Session) KillProcess(pid int) error {
+	s.logWriter.WriteString("Kill process " + strconv.Itoa(pid))
+	return s.Request("ps.kill", ProcessParams{Pid: pid}, nil)
+}
+
+func printProcesses(writer io.Writer, processes []Process) {
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "PID\tPPID\tUSER\tSTARTED\tCOMMAND")
+	for _, process := range processes {
+		started := ""
+		if !process.StartTime.IsZero() {
+			started = process.StartTime.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(table, "%d\t%d\t%s\t%s\t%s\n",
+			process.Pid,
+			process.Ppid,
+			process.User,
+			started,
+			process.Command)
+	}
+	table.Flush()
+}
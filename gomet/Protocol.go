@@ -0,0 +1,360 @@
+package gomet
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+// Protocol spoken on the command stream and at the start of every stream.
+// Each frame is a 4 bytes big endian length followed by a JSON message.
+const ProtocolVersion = 1
+const minProtocolVersion = 1
+
+const maxFrameSize = 16 * 1024 * 1024
+
+const (
+	StatusOk          = "ok"
+	StatusError       = "error"
+	StatusUnsupported = "unsupported"
+)
+
+// UnsupportedError is returned by the requests the agent can't handle on
+// its OS, the OS commands can be used instead.
+type UnsupportedError struct {
+	Message string
+}
+
+func (e *UnsupportedError) Error() string {
+	return e.Message
+}
+
+type Message struct {
+	Id          uint32             `json:"id"`
+	Type        string             `json:"type,omitempty"`
+	Status      string             `json:"status,omitempty"`
+	Error       string             `json:"error,omitempty"`
+	Streams     int                `json:"streams,omitempty"`
+	Compression string             `json:"compression,omitempty"`
+	Cwd         string             `json:"cwd,omitempty"`
+	Env         map[string]*string `json:"env,omitempty"`
+	Data        json.RawMessage    `json:"data,omitempty"`
+}
+
+type Request struct {
+	Type   string
+	Params interface{}
+}
+
+type SystemInfo struct {
+	Version        int            `json:"version"`
+	AgentVersion   string         `json:"agentVersion,omitempty"`
+	AgentId        string         `json:"agentId,omitempty"`
+	BuildId        string         `json:"buildId,omitempty"`
+	Os             string         `json:"os,omitempty"`
+	Arch           string         `json:"arch,omitempty"`
+	Hostname       string         `json:"hostname,omitempty"`
+	Pid            int            `json:"pid,omitempty"`
+	User           string         `json:"user,omitempty"`
+	Uid            string         `json:"uid,omitempty"`
+	Gid            string         `json:"gid,omitempty"`
+	Cwd            string         `json:"cwd,omitempty"`
+	Interfaces     []NetInterface `json:"interfaces,omitempty"`
+	Compressions   []string       `json:"compressions,omitempty"`
+	KillDate       *time.Time     `json:"killDate,omitempty"`
+	OperatingHours string         `json:"operatingHours,omitempty"`
+}
+
+type NetInterface struct {
+	Name         string   `json:"name"`
+	HardwareAddr string   `json:"hardwareAddr,omitempty"`
+	Addresses    []string `json:"addresses"`
+}
+
+// Timeout is in seconds, 0 for none.
+type CommandParams struct {
+	Command string `json:"command"`
+	Timeout int    `json:"timeout,omitempty"`
+}
+
+type ExecuteResult struct {
+	ExitCode int  `json:"exitCode"`
+	Canceled bool `json:"canceled,omitempty"`
+	TimedOut bool `json:"timedOut,omitempty"`
+}
+
+type ShellParams struct {
+	Name string `json:"name,omitempty"`
+	Term string `json:"term,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
+}
+
+type ShellResult struct {
+	Exited   bool `json:"exited"`
+	ExitCode int  `json:"exitCode"`
+}
+
+type ShellInfo struct {
+	Name      string    `json:"name"`
+	Pid       int       `json:"pid"`
+	Attached  bool      `json:"attached"`
+	StartTime time.Time `json:"startTime"`
+}
+
+// WindowSize is sent in "resize" frames on the control stream of a shell.
+type WindowSize struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+type FileParams struct {
+	Path      string `json:"path"`
+	Recursive bool   `json:"recursive,omitempty"`
+}
+
+type TransferParams struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+type TransferInfo struct {
+	Size   int64 `json:"size"`
+	Offset int64 `json:"offset"`
+}
+
+type TransferResult struct {
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+type ArchiveParams struct {
+	Path        string   `json:"path"`
+	Compression string   `json:"compression,omitempty"`
+	Include     []string `json:"include,omitempty"`
+	Exclude     []string `json:"exclude,omitempty"`
+}
+
+type ArchiveResult struct {
+	Files int   `json:"files"`
+	Size  int64 `json:"size"`
+}
+
+type FileEntry struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	IsDir   bool      `json:"isDir"`
+	ModTime time.Time `json:"modTime"`
+	Owner   string    `json:"owner,omitempty"`
+	Group   string    `json:"group,omitempty"`
+}
+
+type MoveParams struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+type ChmodParams struct {
+	Path string `json:"path"`
+	Mode uint32 `json:"mode"`
+}
+
+type Process struct {
+	Pid       int       `json:"pid"`
+	Ppid      int       `json:"ppid"`
+	User      string    `json:"user"`
+	Command   string    `json:"command"`
+	StartTime time.Time `json:"startTime"`
+}
+
+type ProcessParams struct {
+	Pid int `json:"pid"`
+}
+
+type Connection struct {
+	Protocol      string `json:"protocol"`
+	Type          string `json:"type,omitempty"`
+	LocalAddress  string `json:"localAddress"`
+	RemoteAddress string `json:"remoteAddress,omitempty"`
+	State         string `json:"state,omitempty"`
+	User          string `json:"user,omitempty"`
+	Inode         string `json:"inode,omitempty"`
+	Pid           int    `json:"pid,omitempty"`
+}
+
+type AddressParams struct {
+	Address string `json:"address"`
+}
+
+type CancelParams struct {
+	Id uint32 `json:"id"`
+}
+
+// Delay is in seconds before the agent reconnects, 0 for its reconnect interval.
+type LifecycleParams struct {
+	Delay int `json:"delay,omitempty"`
+}
+
+type LifecycleResult struct {
+	Pid        int      `json:"pid"`
+	Executable string   `json:"executable,omitempty"`
+	Removed    []string `json:"removed,omitempty"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+func writeFrame(writer io.Writer, message *Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	_, err = writer.Write(frame)
+	return err
+}
+
+func readFrame(reader io.Reader) (*Message, error) {
+	var header [4]byte
+	_, err := io.ReadFull(reader, header[:])
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return nil, errors.New("Frame too large")
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var message Message
+	err = json.Unmarshal(data, &message)
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// Transfers send data in chunks, each one is a 4 bytes big endian length
+// followed by the data. An empty chunk marks the end of the data.
+const chunkSize = 32 * 1024
+
+type chunkWriter struct {
+	writer io.Writer
+}
+
+func (c *chunkWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		size := len(data)
+		if size > chunkSize {
+			size = chunkSize
+		}
+
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], uint32(size))
+		_, err := c.writer.Write(header[:])
+		if err != nil {
+			return written, err
+		}
+
+		_, err = c.writer.Write(data[:size])
+		if err != nil {
+			return written, err
+		}
+
+		written += size
+		data = data[size:]
+	}
+	return written, nil
+}
+
+type flusher interface {
+	Flush() error
+}
+
+// Close writes the last chunk and flushes the writer if it buffers.
+func (c *chunkWriter) Close() error {
+	var header [4]byte
+	_, err := c.writer.Write(header[:])
+	if err != nil {
+		return err
+	}
+	if f, ok := c.writer.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+type chunkReader struct {
+	reader io.Reader
+	remaining uint32
+	done bool
+}
+
+func (c *chunkReader) Read(data []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+
+	if c.remaining == 0 {
+		var header [4]byte
+		_, err := io.ReadFull(c.reader, header[:])
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		c.remaining = binary.BigEndian.Uint32(header[:])
+		if c.remaining == 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+		if c.remaining > chunkSize {
+			return 0, errors.New("Chunk too large")
+		}
+	}
+
+	if uint32(len(data)) > c.remaining {
+		data = data[:c.remaining]
+	}
+
+	n, err := c.reader.Read(data)
+	c.remaining -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (m *Message) Err() error {
+	if m.Status == StatusError {
+		return errors.New(m.Error)
+	}
+	if m.Status == StatusUnsupported {
+		return &UnsupportedError{Message: m.Error}
+	}
+	return nil
+}
+
+func (m *Message) Decode(value interface{}) error {
+	if len(m.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(m.Data, value)
+}
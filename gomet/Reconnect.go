@@ -0,0 +1,185 @@
+package gomet
+
+import (
+	"fmt"
+	"github.com/xtaci/smux"
+	"log"
+	"time"
+)
+
+/* -----------------
+   Reconnect
+  ------------------ */
+
+// An agent keeps the same AgentId across its connections. When its
+// connection is lost, the session waits for it to reconnect and keeps its
+// Id, notes, log file, jobs and routes. It is closed when the agent doesn't
+// come back within the reconnect window.
+
+func (s *Session) connection() (*smux.Session, *smux.Stream) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.session, s.commandStream
+}
+
+// handle makes session the connection to the agent.
+func (s *Session) handle(session *smux.Session, commandStream *smux.Stream) {
+	done := make(chan struct{})
+
+	s.writeLock.Lock()
+	s.session = session
+	s.commandStream = commandStream
+	s.connectionDone = done
+	s.writeLock.Unlock()
+
+	s.stateLock.Lock()
+	s.disconnected = false
+	s.disconnectReason = ""
+	s.connections++
+	s.lastSeen = time.Now()
+	s.stateLock.Unlock()
+
+	go s.readReplies(commandStream, done)
+	go s.acceptStreams(session)
+}
+
+// disconnect is called when the connection using commandStream is lost,
+// the session is closed if the agent doesn't reconnect in time.
+func (s *Session) disconnect(commandStream *smux.Stream, reason string) {
+	if s.isClosed() {
+		return
+	}
+
+	s.stateLock.Lock()
+	session, current := s.connection()
+	if current != commandStream || s.disconnected {
+		s.stateLock.Unlock()
+		return
+	}
+
+	// The agent left as asked, see leave
+	if s.leaveReason != "" {
+		reason = s.leaveReason
+		s.leaveReason = ""
+		if s.leaveClose {
+			s.stateLock.Unlock()
+			s.server.closeSession(s.Id, reason)
+			return
+		}
+	}
+
+	s.disconnected = true
+	s.disconnectReason = reason
+	connections := s.connections
+	s.stateLock.Unlock()
+
+	session.Close()
+
+	window := s.server.config.ReconnectWindow()
+	log.Printf("Session %d disconnected: %s", s.Id, reason)
+	s.logWriter.WriteString("Session disconnected: " + reason)
+	s.server.disconnectSession(s)
+
+	time.AfterFunc(window, func() {
+		s.stateLock.Lock()
+		expired := s.disconnected && s.connections == connections
+		s.stateLock.Unlock()
+
+		if expired {
+			s.server.closeSession(s.Id, reason + ", no reconnection within " + window.String())
+		}
+	})
+}
+
+// reattach takes the connection of other, a new session of the same agent.
+// It returns false when the session was closed in the meantime or is still
+// connected.
+func (s *Session) reattach(other *Session) bool {
+	if s.isClosed() {
+		return false
+	}
+
+	// Claims the session, only one connection can reattach it
+	s.stateLock.Lock()
+	if !s.disconnected {
+		s.stateLock.Unlock()
+		return false
+	}
+	s.disconnected = false
+	s.stateLock.Unlock()
+
+	s.writeLock.Lock()
+	session := s.session
+	done := s.connectionDone
+	s.writeLock.Unlock()
+
+	// Pending calls belong to the previous connection
+	session.Close()
+	<-done
+
+	s.stateLock.Lock()
+	s.SystemInfo = other.SystemInfo
+	s.Address = other.Address
+	s.stateLock.Unlock()
+
+	s.handle(other.session, other.commandStream)
+
+	log.Printf("Session %d reconnected from %s", s.Id, s.Address)
+	s.logWriter.WriteString("Session reconnected from " + s.Address)
+
+	s.restartJobs()
+	return true
+}
+
+// restartJobs sends again the requests of the jobs, such as remote listeners,
+// and forgets the jobs which can't be restarted and the named shells which
+// didn't survive the reconnection.
+func (s *Session) restartJobs() {
+	for id, job := range s.Jobs() {
+		request := job.GetRequest()
+		if request == nil {
+			continue
+		}
+
+		call, err := s.Send(request)
+		if err != nil {
+			log.Printf("ERROR job %d: %s", id, err)
+			s.logWriter.WriteString(fmt.Sprintf("Job %d dropped: %s", id, err))
+			s.removeJob(id)
+			continue
+		}
+		go job.Start(call, &s.registry, s.logWriter)
+	}
+
+	shells, err := s.ListShells()
+	if err != nil {
+		log.Printf("ERROR %s", err)
+		return
+	}
+
+	running := make(map[string]bool)
+	for _, shell := range shells {
+		running[shell.Name] = true
+	}
+	for id, job := range s.Jobs() {
+		if shell, ok := job.(*ShellJob); ok && !running[shell.name] {
+			s.removeJob(id)
+		}
+	}
+}
+
+// Disconnected returns whether the agent is disconnected and why.
+func (s *Session) Disconnected() (bool, string) {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.disconnected, s.disconnectReason
+}
+
+func (s *Session) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,194 @@
+package gomet
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Scope is the allowlist of the engagement. Hosts are names, "*.example.com"
+// for a domain and its subdomains, or addresses. Ports are numbers or ranges
+// like "8000-8100". An empty list allows everything.
+type Scope struct {
+	CIDRs []string `json:"cidrs"`
+	Hosts []string `json:"hosts"`
+	Ports []string `json:"ports"`
+
+	networks []*net.IPNet
+	ports [][2]int
+}
+
+// compile parses the scope, it is done once when the configuration is loaded.
+func (s *Scope) compile() error {
+	s.networks = nil
+	s.ports = nil
+
+	for _, cidr := range s.CIDRs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return errors.New("Invalid scope CIDR " + cidr)
+		}
+		s.networks = append(s.networks, network)
+	}
+
+	for _, host := range s.Hosts {
+		if strings.TrimSpace(host) == "" || strings.ContainsAny(host, ", ") {
+			return errors.New("Invalid scope host " + host)
+		}
+	}
+
+	for _, value := range s.Ports {
+		bounds := strings.SplitN(strings.TrimSpace(value), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		last := first
+		if err == nil && len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+		}
+		if err != nil || first < 1 || last > 65535 || first > last {
+			return errors.New("Invalid scope port " + value)
+		}
+		s.ports = append(s.ports, [2]int{first, last})
+	}
+	return nil
+}
+
+// Restricted tells if the scope limits the targets.
+func (s *Scope) Restricted() bool {
+	return len(s.CIDRs) > 0 || len(s.Hosts) > 0 || len(s.Ports) > 0
+}
+
+// CheckAddress allows a host:port target.
+func (s *Scope) CheckAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.New("Invalid address " + address)
+	}
+
+	err = s.CheckHost(host)
+	if err != nil {
+		return err
+	}
+	return s.CheckPort(port)
+}
+
+// CheckHost allows an address within the CIDRs or a listed host. Names
+// aren't resolved, they have to be listed.
+func (s *Scope) CheckHost(host string) error {
+	if len(s.CIDRs) == 0 && len(s.Hosts) == 0 {
+		return nil
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range s.Hosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed {
+			return nil
+		}
+		if strings.HasPrefix(allowed, "*.") && (host == allowed[2:] || strings.HasSuffix(host, allowed[1:])) {
+			return nil
+		}
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range s.networks {
+			if network.Contains(ip) {
+				return nil
+			}
+		}
+	}
+	return errors.New("Host " + host + " is out of scope")
+}
+
+func (s *Scope) CheckPort(port string) error {
+	if len(s.ports) == 0 {
+		return nil
+	}
+
+	number, err := strconv.Atoi(port)
+	if err != nil {
+		return errors.New("Invalid port " + port)
+	}
+
+	for _, bounds := range s.ports {
+		if number >= bounds[0] && number <= bounds[1] {
+			return nil
+		}
+	}
+	return errors.New("Port " + port + " is out of scope")
+}
+
+// CheckNetwork allows a route to a network within the CIDRs.
+func (s *Scope) CheckNetwork(cidr string) error {
+	if len(s.CIDRs) == 0 && len(s.Hosts) == 0 {
+		return nil
+	}
+
+	_, route, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return errors.New("Invalid IP or range")
+	}
+
+	routeSize, bits := route.Mask.Size()
+	if routeSize == bits && s.CheckHost(route.IP.String()) == nil {
+		return nil
+	}
+
+	for _, network := range s.networks {
+		size, bits := network.Mask.Size()
+		if len(route.IP) == bits/8 && size <= routeSize && network.Contains(route.IP) {
+			return nil
+		}
+	}
+	return errors.New("Network " + cidr + " is out of scope")
+}
+
+// CheckListen allows a listener on the agent, its port has to be in scope
+// and its address too unless it listens on all of them.
+func (s *Scope) CheckListen(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.New("Invalid address " + address)
+	}
+
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		err = s.CheckHost(host)
+		if err != nil {
+			return err
+		}
+	}
+	return s.CheckPort(port)
+}
+
+// agentSettings adds the scope to the settings patched into an agent.
+func (s *Scope) agentSettings(settings map[string]string) {
+	settings["scopeCidrs"] = joinTrimmed(s.CIDRs)
+	settings["scopeHosts"] = joinTrimmed(s.Hosts)
+	settings["scopePorts"] = joinTrimmed(s.Ports)
+}
+
+func joinTrimmed(values []string) string {
+	trimmed := make([]string, len(values))
+	for i, value := range values {
+		trimmed[i] = strings.TrimSpace(value)
+	}
+	return strings.Join(trimmed, ",")
+}
+
+/* -----------------
+   Server
+  ------------------ */
+
+// checkScope logs violations of the scope, session is nil outside sessions.
+func (s *Server) checkScope(session *Session, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	log.Printf("SCOPE %s", err)
+	if session != nil {
+		session.logWriter.WriteString("Scope violation: " + err.Error())
+	}
+	return err
+}
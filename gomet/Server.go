@@ -5,8 +5,8 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/hex"
-	"encoding/pem"
 	"github.com/ginuerzh/gosocks5"
 	"github.com/pkg/errors"
 	"io"
@@ -14,13 +14,13 @@ import (
 	"log"
 	"net"
 	"os"
-	"os/exec"
-	"os/user"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Server struct {
@@ -34,7 +34,13 @@ type Server struct {
 
 	routes map[string]*Session
 
-	pubKeyHash string
+	// Sessions are closed from their keepalive, sessionsLock guards sessions and routes
+	sessionsLock sync.Mutex
+
+	certs *certificateStore
+
+	ca *certificateAuthority
+	builds *BuildRegistry
 
 	wg *sync.WaitGroup
 
@@ -51,6 +57,8 @@ type Server struct {
 type SessionListener interface {
 	NewSession(session *Session)
 	CloseSession(session *Session)
+	DisconnectSession(session *Session)
+	ReconnectSession(session *Session)
 }
 
 
@@ -92,6 +100,23 @@ func (s *Server) populateOsCommands() {
 }
 
 func (s *Server) Start() {
+	var err error
+	s.ca, err = loadCertificateAuthority()
+	if err != nil {
+		log.Printf("ERROR %s", err)
+	}
+
+	s.certs, err = loadCertificateStore()
+	if err != nil {
+		log.Printf("ERROR %s", err)
+	}
+
+	s.builds, err = loadBuildRegistry()
+	if err != nil {
+		log.Printf("ERROR %s", err)
+		s.builds = &BuildRegistry{builds: make(map[string]*Build)}
+	}
+
 	if s.config.Socks.Enable {
 		go s.startSocks()
 	}
@@ -102,7 +127,7 @@ func (s *Server) Start() {
 }
 
 func (s *Server) Stop() {
-	for _, session := range s.sessions {
+	for _, session := range s.Sessions() {
 		session.Close()
 	}
 	s.listener.Close()
@@ -122,7 +147,13 @@ func (s *Server) handleConnection(conn net.Conn) {
 	}
 
 	if stringMatch("CONNECT .* HTTP/1.1", line) {
-		s.handleNewSession(conn)
+		buildId, err := s.authenticateAgent(conn, reader)
+		if err != nil {
+			s.logFailedConnection(conn, buildId, err)
+			conn.Close()
+			return
+		}
+		s.handleNewSession(conn, buildId)
 	} else if stringMatch("GET /" + s.httpMagic + "/agent/[^/]*/[^ ]* .*", line) {
 		s.handleNewAgent(conn, string(line), reader)
 	} else if stringMatch("GET /" + s.httpMagic+ "/[^ ]* .*", line) {
@@ -134,15 +165,65 @@ func (s *Server) handleConnection(conn net.Conn) {
 	}
 }
 
-func (s *Server) handleNewSession(conn net.Conn) {
+// handleNewSession reattaches an agent which reconnects to its disconnected
+// session with the same build, other agents get a new session.
+func (s *Server) handleNewSession(conn net.Conn, buildId string) {
+	session := NewSession(s, conn)
+	if session == nil {
+		return
+	}
+
+	if session.BuildId != buildId {
+		s.logFailedConnection(conn, session.BuildId, errors.New("Build " + session.BuildId + " authenticated as " + buildId))
+		session.session.Close()
+		return
+	}
+
+	if existing := s.getAgentSession(session.AgentId); existing != nil {
+		if existing.BuildId != session.BuildId {
+			s.logFailedConnection(conn, buildId, errors.Errorf("Agent %s of build %s claimed session %d of build %s", session.AgentId, session.BuildId, existing.Id, existing.BuildId))
+		} else if existing.reattach(session) {
+			for _, listener := range s.sessionListeners {
+				listener.ReconnectSession(existing)
+			}
+			return
+		}
+	}
+
+	s.sessionsLock.Lock()
 	s.sessionIndex++
-	session := NewSession(s, conn, s.sessionIndex)
-	if session != nil {
-		s.sessions[session.Id] = session
-		for _, listener := range s.sessionListeners {
-			listener.NewSession(session)
+	session.Id = s.sessionIndex
+	s.sessions[session.Id] = session
+	s.sessionsLock.Unlock()
+
+	session.start()
+	for _, listener := range s.sessionListeners {
+		listener.NewSession(session)
+	}
+}
+
+// getAgentSession returns the session of the agent, agents too old to
+// send an Id are never reattached.
+func (s *Server) getAgentSession(agentId string) *Session {
+	if agentId == "" {
+		return nil
+	}
+
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+
+	for _, session := range s.sessions {
+		if session.AgentId == agentId {
+			return session
 		}
 	}
+	return nil
+}
+
+func (s *Server) disconnectSession(session *Session) {
+	for _, listener := range s.sessionListeners {
+		listener.DisconnectSession(session)
+	}
 }
 
 
@@ -244,6 +325,9 @@ func sendHttp404Error(conn net.Conn) {
 
 
 func (s *Server) GetSession(sessionId int) (*Session, error) {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+
 	if session, ok := s.sessions[sessionId]; ok {
 		return session, nil
 	} else {
@@ -251,19 +335,63 @@ func (s *Server) GetSession(sessionId int) (*Session, error) {
 	}
 }
 
+// Sessions returns the open sessions sorted by Id.
+func (s *Server) Sessions() []*Session {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Id < sessions[j].Id
+	})
+	return sessions
+}
+
 func (s *Server) CloseSession(sessionId int) error {
-	if session, ok := s.sessions[sessionId]; ok {
+	return s.closeSession(sessionId, "Closed by operator")
+}
+
+// closeSession removes the session and its routes, reason is kept in the session log.
+func (s *Server) closeSession(sessionId int, reason string) error {
+	s.sessionsLock.Lock()
+	session, ok := s.sessions[sessionId]
+	if ok {
 		delete(s.sessions, session.Id)
-		session.Close()
-		for _, listener := range s.sessionListeners {
-			listener.CloseSession(session)
+		for cidr, routeSession := range s.routes {
+			if routeSession == session {
+				delete(s.routes, cidr)
+			}
 		}
-	} else {
+	}
+	s.sessionsLock.Unlock()
+
+	if !ok {
 		return errors.New("Invalid session Id")
 	}
+
+	log.Printf("Session %d closed: %s", session.Id, reason)
+	session.close(reason)
+	for _, listener := range s.sessionListeners {
+		listener.CloseSession(session)
+	}
 	return nil
 }
 
+// Routes returns a copy of the routes.
+func (s *Server) Routes() map[string]*Session {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+
+	routes := make(map[string]*Session, len(s.routes))
+	for cidr, session := range s.routes {
+		routes[cidr] = session
+	}
+	return routes
+}
+
 func (s *Server) RegisterSessionListener(listener SessionListener) {
 	s.sessionListeners = append(s.sessionListeners, listener)
 }
@@ -284,6 +412,14 @@ func (s *Server) AddRoute(cidr string, sessionId int) error {
 		return errors.New("Invalid IP or range")
 	}
 
+	err = s.checkScope(nil, s.config.Scope.CheckNetwork(cidr))
+	if err != nil {
+		return err
+	}
+
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+
 	if _, ok := s.sessions[sessionId]; ok {
 		s.routes[cidr] = s.sessions[sessionId]
 	} else {
@@ -292,7 +428,50 @@ func (s *Server) AddRoute(cidr string, sessionId int) error {
 	return nil
 }
 
+// AddSessionRoutes routes every subnet the session agent is connected to.
+// The routes are added together, the previous ones are restored when one
+// of them is refused.
+func (s *Server) AddSessionRoutes(sessionId int) ([]string, error) {
+	session, err := s.GetSession(sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = session.ListInterfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	previous := s.Routes()
+	subnets := session.Subnets()
+	for i, subnet := range subnets {
+		err = s.AddRoute(subnet, sessionId)
+		if err != nil {
+			s.restoreRoutes(subnets[:i], previous)
+			return nil, err
+		}
+	}
+	return subnets, nil
+}
+
+// restoreRoutes sets the routes of subnets back to their previous session.
+func (s *Server) restoreRoutes(subnets []string, previous map[string]*Session) {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+
+	for _, subnet := range subnets {
+		if session, ok := previous[subnet]; ok {
+			s.routes[subnet] = session
+		} else {
+			delete(s.routes, subnet)
+		}
+	}
+}
+
 func (s *Server) DelRoute(cidr string) error {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+
 	if _, ok := s.routes[cidr]; ok {
 		delete(s.routes, cidr)
 	} else {
@@ -302,6 +481,9 @@ func (s *Server) DelRoute(cidr string) error {
 }
 
 func (s *Server) ClearRoutes() {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+
 	for key, _ := range s.routes {
 		delete(s.routes, key)
 	}
@@ -331,7 +513,15 @@ func (s *Server) handleNewAgent(conn net.Conn, request string, reader *bufio.Rea
 		log.Printf("Agent request Os:%s Arch:%s", os, arch)
 		log.Printf("HTTP headers %s", headers)
 
-		agentContent, err := s.GenerateAgent(os,arch, headers["host"], "", "", "", "", s.pubKeyHash)
+		var build Build
+		var agentContent []byte
+		limits, err := s.config.AgentLimits()
+		if err == nil {
+			build, agentContent, err = s.GenerateAgent(os,arch, headers["host"], "", "", "", "", s.PinnedKeys(), s.config.ReconnectPolicy(), limits)
+		}
+		if err == nil {
+			err = s.builds.AddDelivery(build.Id, "downloaded by " + conn.RemoteAddr().String())
+		}
 		if err != nil {
 			log.Printf("ERROR %s", err)
 			conn.Write([]byte("HTTP/1.1 500 Server Error\r\n\r\n"))
@@ -345,49 +535,95 @@ func (s *Server) handleNewAgent(conn net.Conn, request string, reader *bufio.Rea
 }
 
 
-func (s *Server) GenerateAgent(goos string, goarch string, host string, httpProxyHost string, httpsProxyHost string, proxyUsername string, proxyPassword string, pubKeySum string) ([]byte, error) {
+// GenerateAgent patches the settings of a new build into the agent template
+// of the target and records it in the build registry, pubKeySums is the
+// comma separated list of the server keys it accepts, see PinnedKeys.
+func (s *Server) GenerateAgent(goos string, goarch string, host string, httpProxyHost string, httpsProxyHost string, proxyUsername string, proxyPassword string, pubKeySums string, reconnect ReconnectPolicy, limits AgentLimits) (Build, []byte, error) {
 
-	tempDir, err := ioutil.TempDir("", "agent")
+	if s.ca == nil {
+		return Build{}, nil, errors.New("No CA to issue the agent certificate")
+	}
+
+	template, err := loadAgentTemplate(goos, goarch)
 	if err != nil {
-		return nil, err
+		return Build{}, nil, err
 	}
 
-	defer os.RemoveAll(tempDir)
+	buildId := randomString(16)
 
-	log.Printf("New agent in %s\n", tempDir)
+	secret, err := randomSecret()
+	if err != nil {
+		return Build{}, nil, err
+	}
 
-	ldflags := "-X main.connectHost=" + host
-	ldflags += " -X main.httpProxyHost=" + httpProxyHost
-	ldflags += " -X main.httpsProxyHost=" + httpsProxyHost
-	ldflags += " -X main.proxyUsername=" + proxyUsername
-	ldflags += " -X main.proxyPassword=" + proxyPassword
-	ldflags += " -X main.pubKeySum=" + pubKeySum
+	log.Printf("New agent %s for %s/%s, %s\n", buildId, goos, goarch, limits)
+
+	settings := map[string]string{
+		"connectHost": host,
+		"httpProxyHost": httpProxyHost,
+		"httpsProxyHost": httpsProxyHost,
+		"proxyUsername": proxyUsername,
+		"proxyPassword": proxyPassword,
+		"pubKeySums": pubKeySums,
+		"buildId": buildId,
+		"buildSecret": secret,
+		"reconnectInterval": strconv.Itoa(reconnect.Interval),
+		"reconnectMaxInterval": strconv.Itoa(reconnect.MaxInterval),
+		"reconnectMaxRetries": strconv.Itoa(reconnect.MaxRetries),
+		"keepaliveInterval": strconv.Itoa(int(s.config.KeepaliveInterval() / time.Second)),
+		"keepaliveTimeout": strconv.Itoa(int(s.config.KeepaliveTimeout() / time.Second)),
+	}
+	s.config.Scope.agentSettings(settings)
+	if !limits.KillDate.IsZero() {
+		settings["killDate"] = strconv.FormatInt(limits.KillDate.Unix(), 10)
+	}
+	if limits.OperatingHours != "" {
+		settings["operatingHours"] = strings.Replace(limits.OperatingHours, " ", "", -1)
+	}
 
-	usr, err := user.Current()
+	// No certificate is issued for an agent which can't be generated
+	err = checkAgentTemplate(template, settings)
 	if err != nil {
-		log.Printf("ERROR %s", err)
-		return nil, err
+		return Build{}, nil, err
 	}
 
-	cmd := exec.Command("go", "build", "-i", "-o", tempDir + "/agent", "-pkgdir", tempDir, "-ldflags", ldflags)
-	cmd.Env = []string {"GOOS=" + goos,"GOARCH=" + goarch, "GOPATH=" + usr.HomeDir + "/go", "PATH=" + os.Getenv("PATH"), "GOCACHE=" + tempDir}
-	cmd.Dir = "./agent"
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Start()
-
-	log.Println("Building agent...")
-	cmd.Wait()
+	clientCert, clientKey, serial, err := s.ca.issue(buildId, limits.KillDate)
+	if err != nil {
+		return Build{}, nil, err
+	}
+	settings["clientCert"] = base64.StdEncoding.EncodeToString(clientCert)
+	settings["clientKey"] = base64.StdEncoding.EncodeToString(clientKey)
 
-	agentContent, err := ioutil.ReadFile(tempDir + "/agent")
+	agentContent, err := patchAgentTemplate(template, settings)
+	if err != nil {
+		log.Println("ERROR Failed to patch the agent template")
+		return Build{}, nil, err
+	}
 
-	if err == nil {
-		log.Println("Agent build success")
-	} else {
-		log.Println("ERROR Failed to build agent")
+	sum := sha256.Sum256(agentContent)
+	build := Build{
+		Id: buildId,
+		Os: goos,
+		Arch: goarch,
+		Host: host,
+		HttpProxy: httpProxyHost,
+		HttpsProxy: httpsProxyHost,
+		ProxyUsername: proxyUsername,
+		OperatingHours: limits.OperatingHours,
+		Reconnect: reconnect,
+		Sha256: hex.EncodeToString(sum[:]),
+		Size: len(agentContent),
+		Serial: serial,
+		Secret: secret,
+		CreatedAt: time.Now(),
+	}
+	if !limits.KillDate.IsZero() {
+		build.KillDate = &limits.KillDate
 	}
 
-	return agentContent, err
+	err = s.builds.Add(&build)
+	build.Secret = ""
+	return build, agentContent, err
 }
 
 /* -------------------
@@ -398,9 +634,12 @@ func (s *Server) getSessionRoute(ip string) *Session {
 
 	ipAddr := net.ParseIP(ip)
 	if ipAddr == nil {
-		log.Println("Invalid ip %s", ip)
+		log.Printf("Invalid ip %s", ip)
 	}
 
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+
 	for cidr, session := range s.routes {
 		_, ipnet, _ := net.ParseCIDR(cidr)
 
@@ -459,6 +698,13 @@ func (s *Server) startSocks() {
 
 		log.Printf("Request %s", req)
 
+		err = s.checkScope(nil, s.config.Scope.CheckAddress(req.Addr.String()))
+		if err != nil {
+			gosocks5.NewReply(gosocks5.NotAllowed, nil).Write(conn)
+			conn.Close()
+			continue
+		}
+
 		rep := gosocks5.NewReply(gosocks5.Succeeded, nil)
 		if err := rep.Write(conn); err != nil {
 			log.Printf("ERROR %s", err)
@@ -491,28 +737,27 @@ func (s *Server) startListener() {
 
 	log.Println("Starting listener")
 
-	cert, err := tls.LoadX509KeyPair("config/server.crt", "config/server.key")
-	if err != nil {
-		log.Printf("ERROR %s", err)
+	if s.certs == nil {
+		log.Printf("ERROR No server certificate")
 		return
 	}
+	log.Printf("Pinned public key sums %s", s.PinnedKeys())
 
-	pemBytes, err := ioutil.ReadFile("config/server.pub")
-	if err != nil {
-		log.Printf("ERROR %s", err)
+	if s.ca == nil {
+		log.Printf("ERROR No CA to verify the agents")
 		return
 	}
 
-	block, _ := pem.Decode(pemBytes)
-
-	sha256 := sha256.New()
-	sha256.Write(block.Bytes)
-	s.pubKeyHash = hex.EncodeToString(sha256.Sum(nil))
-	log.Printf("Public key sum %s", s.pubKeyHash)
-
-	config := tls.Config{Certificates: []tls.Certificate{cert}}
+	// Agents must present a certificate, checked by authenticateAgent, but
+	// the agent and file downloads of the same listener don't have one.
+	config := tls.Config{
+		GetCertificate: s.certs.getCertificate,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs: s.ca.pool(),
+	}
 	config.Rand = rand.Reader
 
+	var err error
 	s.listener, err = tls.Listen("tcp", s.config.ListenAddr, &config)
 	if err != nil {
 		log.Printf("ERROR %s", err)
@@ -0,0 +1,362 @@
+package gomet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	serverCertFile = "config/server.crt"
+	serverKeyFile  = "config/server.key"
+	serverPubFile  = "config/server.pub"
+	certsDirectory = "config/certs"
+)
+
+// ServerCertificate is a certificate of the listener. Agents pin the hash
+// of its public key, they are built with the hashes of all the known
+// certificates so the active one can be rotated to any of them.
+type ServerCertificate struct {
+	Id        string    `json:"id"`
+	KeyHash   string    `json:"keyHash"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	Active    bool      `json:"active"`
+
+	certificate tls.Certificate
+}
+
+// certificateStore keeps the certificates in config/certs, the active one
+// is also config/server.crt and config/server.key.
+type certificateStore struct {
+	lock sync.Mutex
+	certificates map[string]*ServerCertificate
+	active *ServerCertificate
+}
+
+// loadCertificateStore loads the certificates, a certificate is created the
+// first time and the active one imported when it isn't in the store.
+func loadCertificateStore() (*certificateStore, error) {
+	store := certificateStore{certificates: make(map[string]*ServerCertificate)}
+
+	err := os.MkdirAll(certsDirectory, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(certsDirectory, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		certificate, err := loadServerCertificate(file, strings.TrimSuffix(file, ".crt") + ".key")
+		if err != nil {
+			log.Printf("ERROR %s: %s", file, err)
+			continue
+		}
+		store.certificates[certificate.Id] = certificate
+	}
+
+	active, err := loadServerCertificate(serverCertFile, serverKeyFile)
+	if os.IsNotExist(err) {
+		log.Println("Creating the server certificate")
+		active, err = store.create()
+		if err != nil {
+			return nil, err
+		}
+		return &store, store.activate(active)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := store.certificates[active.Id]; !ok {
+		err = copyServerCertificate(serverCertFile, serverKeyFile, certificatePath(active.Id))
+		if err != nil {
+			return nil, err
+		}
+		store.certificates[active.Id] = active
+	}
+
+	store.active = store.certificates[active.Id]
+	store.active.Active = true
+	return &store, nil
+}
+
+func loadServerCertificate(certFile string, keyFile string) (*ServerCertificate, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	certificate.Leaf = leaf
+
+	keyHash, err := publicKeyHash(leaf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ServerCertificate{
+		Id: keyHash[:16],
+		KeyHash: keyHash,
+		NotBefore: leaf.NotBefore,
+		NotAfter: leaf.NotAfter,
+		certificate: certificate,
+	}, nil
+}
+
+// publicKeyHash is the pin checked by the agents.
+func publicKeyHash(certificate *x509.Certificate) (string, error) {
+	key, err := x509.MarshalPKIXPublicKey(certificate.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func certificatePath(id string) string {
+	return filepath.Join(certsDirectory, id)
+}
+
+func copyServerCertificate(certFile string, keyFile string, path string) error {
+	for source, destination := range map[string]string{certFile: path + ".crt", keyFile: path + ".key"} {
+		content, err := ioutil.ReadFile(source)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(destination, content, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// create generates a new certificate, it is pinned by the agents built from
+// now on and isn't used until it is activated.
+func (c *certificateStore) create() (*ServerCertificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{CommonName: randomString(12)},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().AddDate(10, 0, 0),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	keyHash, err := publicKeyHash(leaf)
+	if err != nil {
+		return nil, err
+	}
+
+	path := certificatePath(keyHash[:16])
+	err = ioutil.WriteFile(path + ".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(path + ".crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := loadServerCertificate(path + ".crt", path + ".key")
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	c.certificates[certificate.Id] = certificate
+	c.lock.Unlock()
+	return certificate, nil
+}
+
+// activate makes the listener use certificate from its next connection.
+func (c *certificateStore) activate(certificate *ServerCertificate) error {
+	path := certificatePath(certificate.Id)
+	err := copyServerCertificate(path + ".crt", path + ".key", "config/server")
+	if err != nil {
+		return err
+	}
+
+	key, err := x509.MarshalPKIXPublicKey(certificate.certificate.Leaf.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(serverPubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: key}), 0644)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.active != nil {
+		c.active.Active = false
+	}
+	c.active = certificate
+	c.active.Active = true
+	return nil
+}
+
+// rotate activates an existing certificate. A new certificate is never
+// activated at once, the agents already deployed don't pin its key.
+func (c *certificateStore) rotate(id string) (*ServerCertificate, error) {
+	c.lock.Lock()
+	certificate := c.certificates[id]
+	c.lock.Unlock()
+
+	if certificate == nil {
+		return nil, errors.New("Unknown certificate " + id)
+	}
+	if time.Now().After(certificate.NotAfter) {
+		return nil, errors.New("Certificate " + id + " expired")
+	}
+
+	err := c.activate(certificate)
+	if err != nil {
+		return nil, err
+	}
+	return certificate, nil
+}
+
+func (c *certificateStore) list() []ServerCertificate {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	certificates := make([]ServerCertificate, 0, len(c.certificates))
+	for _, certificate := range c.certificates {
+		certificates = append(certificates, *certificate)
+	}
+	sort.Slice(certificates, func(i, j int) bool {
+		return certificates[i].NotBefore.Before(certificates[j].NotBefore)
+	})
+	return certificates
+}
+
+// pins returns the key hashes of the certificates which didn't expire, the
+// active one first.
+func (c *certificateStore) pins() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var pins []string
+	if c.active != nil {
+		pins = append(pins, c.active.KeyHash)
+	}
+	for _, certificate := range c.certificates {
+		if certificate != c.active && time.Now().Before(certificate.NotAfter) {
+			pins = append(pins, certificate.KeyHash)
+		}
+	}
+	return pins
+}
+
+func (c *certificateStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.active == nil {
+		return nil, errors.New("No server certificate")
+	}
+	return &c.active.certificate, nil
+}
+
+func printServerCertificates(writer io.Writer, certificates []ServerCertificate) {
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	for _, certificate := range certificates {
+		status := ""
+		if certificate.Active {
+			status = "active"
+		} else if time.Now().After(certificate.NotAfter) {
+			status = "expired"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n",
+			certificate.Id,
+			certificate.NotAfter.Local().Format("2006-01-02"),
+			certificate.KeyHash,
+			status)
+	}
+	table.Flush()
+}
+
+/* -----------------
+   Server
+  ------------------ */
+
+func (s *Server) ServerCertificates() []ServerCertificate {
+	return s.certs.list()
+}
+
+func (s *Server) CreateServerCertificate() (*ServerCertificate, error) {
+	return s.certs.create()
+}
+
+// RotateServerCertificate activates a certificate created earlier. Agents
+// which don't pin its key can't connect anymore.
+func (s *Server) RotateServerCertificate(id string) (*ServerCertificate, error) {
+	certificate, err := s.certs.rotate(id)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Server certificate %s activated", certificate.Id)
+	return certificate, nil
+}
+
+// PinnedKeys returns the key hashes pinned by the agents, comma separated.
+func (s *Server) PinnedKeys() string {
+	if s.certs == nil {
+		return ""
+	}
+	return strings.Join(s.certs.pins(), ",")
+}
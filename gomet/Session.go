@@ -1,12 +1,17 @@
 package gomet
 
 import (
-	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"github.com/xtaci/smux"
+	"hash"
+	"io"
 	"log"
 	"net"
 	"os"
-	"strings"
+	"sync"
 	"time"
 )
 
@@ -54,39 +59,179 @@ func (t *LogWriter) WriteString(s string) (n int, err error) {
 }
 
 
+// Call tracks a request sent to the agent. Streams opened by the agent for
+// this request and its final reply are dispatched to it by request Id.
+type Call struct {
+	Id uint32
+
+	session *Session
+	streams chan namedStream
+	replies chan *Message
+	reply *Message
+
+	compression string
+	counter *ByteCounter
+	interactive bool
+
+	accepted int
+	delivered int
+	expected int
+	replied bool
+}
+
+type namedStream struct {
+	stream *smux.Stream
+	name string
+}
+
+func (c *Call) AcceptStream() (*smux.Stream, error) {
+	stream, _, err := c.AcceptNamedStream()
+	return stream, err
+}
+
+// AcceptNamedStream returns the next stream of the request with the name
+// given by the agent, for requests using several streams.
+func (c *Call) AcceptNamedStream() (*smux.Stream, string, error) {
+	for {
+		if c.reply != nil && c.accepted >= c.reply.Streams {
+			err := c.reply.Err()
+			if err == nil {
+				err = io.EOF
+			}
+			return nil, "", err
+		}
+
+		select {
+		case named := <-c.streams:
+			c.accepted++
+			return named.stream, named.name, nil
+		case reply := <-c.replies:
+			c.reply = reply
+		}
+	}
+}
+
+// DataStream wraps a stream of the call with the compression asked to the agent.
+func (c *Call) DataStream(stream *smux.Stream) io.ReadWriteCloser {
+	return newDataStream(stream, c.compression, c.counter, c.interactive)
+}
+
+func (c *Call) Wait() (*Message, error) {
+	if c.reply == nil {
+		c.reply = <-c.replies
+	}
+	return c.reply, c.reply.Err()
+}
+
+// WaitTimeout is Wait giving up after timeout, the reply is then nil.
+func (c *Call) WaitTimeout(timeout time.Duration) (*Message, error) {
+	if c.reply == nil {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case c.reply = <-c.replies:
+		case <-timer.C:
+			return nil, errors.New("Timeout")
+		}
+	}
+	return c.reply, c.reply.Err()
+}
+
+func (c *Call) Cancel() {
+	_, err := c.session.Send(&Request{
+		Type: "cancel",
+		Params: CancelParams{Id: c.Id},
+	})
+	if err != nil {
+		log.Printf("ERROR %s", err)
+	}
+}
+
+
 type Session struct {
 	Id int `json:"id"`
-	Os       string `json:"os"`
-	Arch     string `json:"arch"`
-	Hostname string `json:"hostname"`
 	Address  string `json:"address"`
 
+	SystemInfo
+
+	// jobIndex and jobs are guarded by jobsLock, reconnections restart the
+	// jobs while the CLI lists and kills them
+	jobsLock sync.Mutex
 	jobIndex int
 	jobs map[int]*Command
 
 	registry Registry
 
+	callIndex uint32
+	calls map[uint32]*Call
+	callsLock sync.Mutex
+	writeLock sync.Mutex
+
+	compressions map[string]string
+	counters map[string]*ByteCounter
+	compressionLock sync.Mutex
+
+	transferIndex int
+	transfers map[int]*Transfer
+	transfersLock sync.Mutex
+
+	workingDirectory string
+	env map[string]*string
+	envLock sync.Mutex
+
+	notes []Note
+
+	lastSeen time.Time
+	latency time.Duration
+	closeReason string
+	disconnected bool
+	disconnectReason string
+	leaveReason string
+	leaveClose bool
+	connections int
+	stateLock sync.Mutex
+	closed chan struct{}
+	closeOnce sync.Once
+
 	server *Server
+
+	// The connection to the agent is replaced when it reconnects, writeLock guards it.
 	session *smux.Session
 	commandStream *smux.Stream
+	connectionDone chan struct{}
+
 	logWriter *LogWriter
 }
 
-func NewSession(server *Server, conn net.Conn, id int) *Session {
+type Note struct {
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+}
+
+// NewSession does the handshake with the agent, the server then gives the
+// session an Id or reattaches the agent to its previous session.
+func NewSession(server *Server, conn net.Conn) *Session {
 
 	log.Printf("Handle a new session")
 
 	var err error
 
 	var s = Session{
-		Id:       id,
 		server:   server,
 		jobIndex: 0,
 		jobs:     make(map[int]*Command),
 		registry: NewRegistry(),
+		calls:    make(map[uint32]*Call),
+		compressions: make(map[string]string),
+		counters: make(map[string]*ByteCounter),
+		transfers: make(map[int]*Transfer),
+		env: make(map[string]*string),
+		lastSeen: time.Now(),
+		closed: make(chan struct{}),
 	}
 
-	s.session, err = smux.Client(conn, nil)
+	s.session, err = smux.Client(conn, server.config.smuxConfig())
 	if err != nil {
 		log.Printf("ERROR %s", err)
 		return nil
@@ -100,60 +245,145 @@ func NewSession(server *Server, conn net.Conn, id int) *Session {
 
 	log.Printf("Command stream opened")
 
-	reader := bufio.NewReader(s.commandStream)
-	systemInfo, _, err := reader.ReadLine()
+	info, err := s.handshake()
 	if err != nil {
 		s.commandStream.Close()
 		log.Printf("ERROR %s", err)
 		return nil
 	}
 
-	array := strings.Split(string(systemInfo), "|")
-	if len(array) != 3 {
-		s.commandStream.Close()
-		log.Printf("Invalid system info format")
-		return nil
+	s.SystemInfo = *info
+	s.Address = conn.RemoteAddr().String()
+
+	compression := server.config.Compression
+	if compression.Algorithm != CompressionNone {
+		err = s.SetCompression(compression.Algorithm, compression.Streams)
+		if err != nil {
+			log.Printf("ERROR %s", err)
+		}
 	}
 
-	s.Os = array[0]
-	s.Arch = array[1]
-	s.Hostname = array[2]
-	s.Address = conn.RemoteAddr().String()
+	return &s
+}
 
+// start handles the session once it is registered by the server.
+func (s *Session) start() {
 	current_time := time.Now().Local()
 	file, err := os.OpenFile("logs/" + current_time.Format("2006-01-02") + "_" + s.Hostname + ".log", os.O_RDWR | os.O_CREATE | os.O_APPEND, 0666)
+	if err != nil {
+		log.Printf("ERROR %s", err)
+	}
 	s.logWriter = &LogWriter{
 		Logger: log.New(file, "", log.LstdFlags),
 	}
 
-	return &s
+	s.handle(s.session, s.commandStream)
+	go s.keepalive()
 }
 
 
-func (s *Session) RunCommand(command Command) {
+func (s *Session) RunCommand(command Command) error {
+
+	if checker, ok := command.(scopeChecker); ok {
+		err := s.server.checkScope(s, checker.checkScope(&s.server.config.Scope))
+		if err != nil {
+			return err
+		}
+	}
 
 	s.logWriter.WriteString(command.String())
 
-	if command.GetRemoteCommand() != "" {
-		s.commandStream.Write([]byte(command.GetRemoteCommand()))
+	var call *Call
+	if request := command.GetRequest(); request != nil {
+		var err error
+		call, err = s.Send(request)
+		if err != nil {
+			log.Printf("ERROR %s", err)
+			return err
+		}
 	}
+
 	if command.IsJob() {
-		s.runBackgroundCommand(command)
+		s.runBackgroundCommand(command, call)
 	} else {
-		s.runInteractiveCommand(command)
+		s.runInteractiveCommand(command, call)
 	}
+	return nil
+}
+
+func (s *Session) Send(request *Request) (*Call, error) {
+
+	params, err := json.Marshal(request.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	call := s.newCall()
+	call.compression, call.counter = s.getCompression(request.Type)
+	call.interactive = isInteractiveStream(request.Type)
+	cwd, env := s.Environment()
+
+	s.writeLock.Lock()
+	err = writeFrame(s.commandStream, &Message{
+		Id: call.Id,
+		Type: request.Type,
+		Compression: call.compression,
+		Cwd: cwd,
+		Env: env,
+		Data: params,
+	})
+	s.writeLock.Unlock()
+
+	if err != nil {
+		s.callsLock.Lock()
+		delete(s.calls, call.Id)
+		s.callsLock.Unlock()
+		return nil, err
+	}
+	return call, nil
+}
+
+// Request sends a request which doesn't use any stream and decodes its result.
+func (s *Session) Request(requestType string, params interface{}, result interface{}) error {
+
+	call, err := s.Send(&Request{
+		Type: requestType,
+		Params: params,
+	})
+	if err != nil {
+		return err
+	}
+
+	reply, err := call.Wait()
+	if err != nil {
+		return err
+	}
+
+	if result != nil {
+		return reply.Decode(result)
+	}
+	return nil
 }
 
 func (s *Session) ConnectToRemote(conn net.Conn, remoteAddress string) {
 
-	_, err := s.commandStream.Write([]byte("5\n" + remoteAddress + "\n"))
+	err := s.server.checkScope(s, s.server.config.Scope.CheckAddress(remoteAddress))
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	call, err := s.Send(&Request{
+		Type: "connect",
+		Params: AddressParams{Address: remoteAddress},
+	})
 	if err != nil {
 		log.Printf("ERROR %s", err)
 		conn.Close()
 		return
 	}
 
-	stream, err := s.session.AcceptStream()
+	stream, err := call.AcceptStream()
 	if err != nil {
 		log.Printf("ERROR %s", err)
 		conn.Close()
@@ -164,67 +394,443 @@ func (s *Session) ConnectToRemote(conn net.Conn, remoteAddress string) {
 }
 
 
-func (s *Session) DownloadFile(remoteFilename string, localFilename string) {
+// DownloadFile resumes from <localFilename>.part when a previous download
+// of the file was interrupted.
+func (s *Session) DownloadFile(remoteFilename string, localFilename string) error {
+	transfer, err := s.NewTransfer(TransferDownload, remoteFilename, localFilename, ArchiveOptions{})
+	if err != nil {
+		return err
+	}
 
-	file, err := os.OpenFile(localFilename, os.O_RDWR|os.O_CREATE, 0755)
+	err = s.downloadFile(transfer)
+	s.finishTransfer(transfer, nil, err)
+	return err
+}
+
+// UploadFile resumes from the size of <remoteFilename>.part on the agent
+// when a previous upload of the file was interrupted.
+func (s *Session) UploadFile(localFilename string, remoteFilename string) error {
+	transfer, err := s.NewTransfer(TransferUpload, localFilename, remoteFilename, ArchiveOptions{})
 	if err != nil {
-		log.Printf("ERROR %s", err)
-		return
+		return err
 	}
 
-	defer file.Close()
+	err = s.uploadFile(transfer)
+	s.finishTransfer(transfer, nil, err)
+	return err
+}
 
-	s.RunCommand(&Download{
-		writer: file,
-		remoteFilename: remoteFilename,
+func (s *Session) DownloadDirectory(remoteDirectory string, localDirectory string, options ArchiveOptions) (*ArchiveResult, error) {
+	transfer, err := s.NewTransfer(TransferDownload, remoteDirectory, localDirectory, options)
+	if err != nil {
+		return nil, err
+	}
+
+	transfer.setDirectory()
+	result, err := s.downloadDirectory(transfer)
+	s.finishTransfer(transfer, result, err)
+	return result, err
+}
+
+func (s *Session) UploadDirectory(localDirectory string, remoteDirectory string, options ArchiveOptions) (*ArchiveResult, error) {
+	transfer, err := s.NewTransfer(TransferUpload, localDirectory, remoteDirectory, options)
+	if err != nil {
+		return nil, err
+	}
+
+	transfer.setDirectory()
+	result, err := s.uploadDirectory(transfer)
+	s.finishTransfer(transfer, result, err)
+	return result, err
+}
+
+func (s *Session) Close() {
+	s.close("Closed")
+}
+
+func (s *Session) close(reason string) {
+	s.closeOnce.Do(func() {
+		s.stateLock.Lock()
+		s.closeReason = reason
+		s.stateLock.Unlock()
+
+		close(s.closed)
+		s.logWriter.WriteString("Session closed: " + reason)
+
+		for _, job := range s.Jobs() {
+			job.Stop()
+		}
+
+		s.Send(&Request{Type: "close"})
+
+		session, commandStream := s.connection()
+		commandStream.Close()
+		session.Close()
 	})
 }
 
-func (s *Session) UploadFile(localFilename string, remoteFilename string) {
+func (s *Session) String() string {
+	return s.Hostname + " - " + s.Address + " - " + s.Os + "/" + s.Arch
+}
+
+// AddNote keeps a note on the session, it is also written to the session log.
+func (s *Session) AddNote(text string) {
+	s.stateLock.Lock()
+	s.notes = append(s.notes, Note{Time: time.Now(), Text: text})
+	s.stateLock.Unlock()
+
+	s.logWriter.WriteString("Note: " + text)
+}
+
+func (s *Session) Notes() []Note {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	return append([]Note(nil), s.notes...)
+}
+
 
-	file, err := os.OpenFile(localFilename, os.O_RDONLY, 0755)
+/* Private functions */
+
+func (s *Session) handshake() (*SystemInfo, error) {
+
+	message, err := readFrame(s.commandStream)
+	if err != nil {
+		return nil, err
+	}
+
+	var info SystemInfo
+	err = message.Decode(&info)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := Message{Id: message.Id, Type: "hello", Status: StatusOk}
+	if message.Type != "hello" {
+		err = errors.New("Invalid handshake")
+	} else if info.Version < minProtocolVersion || info.Version > ProtocolVersion {
+		err = errors.New("Unsupported protocol version")
+	}
+
+	if err != nil {
+		reply.Status = StatusError
+		reply.Error = err.Error()
+	} else {
+		reply.Data, _ = json.Marshal(SystemInfo{Version: ProtocolVersion})
+	}
+
+	writeErr := writeFrame(s.commandStream, &reply)
+	if err == nil {
+		err = writeErr
+	}
+	return &info, err
+}
+
+// readReplies reads the replies of the agent until the connection is lost,
+// then fails the pending calls and closes done.
+func (s *Session) readReplies(commandStream *smux.Stream, done chan struct{}) {
+	var err error
+	for {
+		var reply *Message
+		reply, err = readFrame(commandStream)
+		if err != nil {
+			log.Printf("ERROR %s", err)
+			break
+		}
+
+		s.seen()
+
+		s.callsLock.Lock()
+		call, ok := s.calls[reply.Id]
+		if ok {
+			call.replied = true
+			call.expected = reply.Streams
+			s.releaseCall(call)
+		}
+		s.callsLock.Unlock()
+
+		if ok {
+			call.replies <- reply
+		} else {
+			log.Printf("Unexpected reply %d", reply.Id)
+		}
+	}
+
+	s.failCalls(errors.New("Session closed"))
+	close(done)
+
+	s.disconnect(commandStream, "Connection lost: " + err.Error())
+}
+
+func (s *Session) acceptStreams(session *smux.Session) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			log.Printf("ERROR %s", err)
+			break
+		}
+		go s.dispatchStream(stream)
+	}
+}
+
+func (s *Session) dispatchStream(stream *smux.Stream) {
+
+	header, err := readFrame(stream)
 	if err != nil {
 		log.Printf("ERROR %s", err)
+		stream.Close()
+		return
+	}
+
+	s.callsLock.Lock()
+	call, ok := s.calls[header.Id]
+	if ok {
+		call.delivered++
+		s.releaseCall(call)
+	}
+	s.callsLock.Unlock()
+
+	if !ok {
+		log.Printf("Unexpected stream for request %d", header.Id)
+		stream.Close()
 		return
 	}
 
+	log.Printf("New stream opened for request %d", header.Id)
+	call.streams <- namedStream{stream: stream, name: header.Type}
+}
+
+func (s *Session) newCall() *Call {
+	s.callsLock.Lock()
+	defer s.callsLock.Unlock()
+
+	s.callIndex++
+	call := &Call{
+		Id: s.callIndex,
+		session: s,
+		streams: make(chan namedStream, 64),
+		replies: make(chan *Message, 1),
+	}
+	s.calls[call.Id] = call
+	return call
+}
+
+// releaseCall forgets a call once its reply and all its streams were received.
+// Must be called with callsLock held.
+func (s *Session) releaseCall(call *Call) {
+	if call.replied && call.delivered >= call.expected {
+		delete(s.calls, call.Id)
+	}
+}
+
+func (s *Session) failCalls(err error) {
+	s.callsLock.Lock()
+	defer s.callsLock.Unlock()
+
+	for id, call := range s.calls {
+		delete(s.calls, id)
+		if !call.replied {
+			call.replies <- &Message{
+				Id: id,
+				Status: StatusError,
+				Error: err.Error(),
+				Streams: call.delivered,
+			}
+		}
+	}
+}
+
+func (s *Session) downloadFile(transfer *Transfer) error {
+
+	var offset int64
+	sum := sha256.New()
+	partFilename := transfer.Destination + ".part"
+
+	file, err := os.Open(partFilename)
+	if err == nil {
+		offset, err = io.Copy(sum, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		log.Printf("Resume download of %s at %d", transfer.Source, offset)
+	}
+
+	err = s.downloadFrom(transfer, offset, sum)
+	if err != nil && offset > 0 {
+		// The remote file may have changed since the part was written, start again from 0
+		log.Printf("Resume of %s failed (%s), restart from 0", transfer.Source, err)
+		removeErr := os.Remove(partFilename)
+		if removeErr != nil && !os.IsNotExist(removeErr) {
+			return removeErr
+		}
+		err = s.downloadFrom(transfer, 0, sha256.New())
+	}
+	return err
+}
+
+func (s *Session) downloadFrom(transfer *Transfer, offset int64, sum hash.Hash) error {
+
+	download := Download{
+		localFilename: transfer.Destination,
+		remoteFilename: transfer.Source,
+		offset: offset,
+		sum: sum,
+		transfer: transfer,
+	}
+
+	err := s.RunCommand(&download)
+	if err != nil {
+		return err
+	}
+	return download.err
+}
+
+func (s *Session) uploadFile(transfer *Transfer) error {
+
+	file, err := os.Open(transfer.Source)
+	if err != nil {
+		return err
+	}
+
 	defer file.Close()
 
-	s.RunCommand(&Upload{
-		reader: file,
-		remoteFilename: remoteFilename,
-	})
+	sum := sha256.New()
+	size, err := io.Copy(sum, file)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	part, err := s.StatFile(transfer.Destination + ".part")
+	if err == nil && !part.IsDir && part.Size <= size {
+		offset = part.Size
+		log.Printf("Resume upload of %s at %d", transfer.Source, offset)
+	}
+
+	err = s.uploadFrom(transfer, file, size, hex.EncodeToString(sum.Sum(nil)), offset)
+	if err != nil && offset > 0 {
+		// The agent drops a stale or corrupted part, start again from 0
+		log.Printf("Resume of %s failed (%s), restart from 0", transfer.Source, err)
+		err = s.uploadFrom(transfer, file, size, hex.EncodeToString(sum.Sum(nil)), 0)
+	}
+	return err
 }
 
-func (s *Session) Close() {
+func (s *Session) uploadFrom(transfer *Transfer, file *os.File, size int64, sha256 string, offset int64) error {
 
-	for _, job := range s.jobs {
-		(*job).Stop()
+	_, err := file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
 	}
 
-	s.commandStream.Write([]byte("6\n"))
-	s.commandStream.Close()
-	s.session.Close()
+	upload := Upload{
+		reader: file,
+		remoteFilename: transfer.Destination,
+		size: size,
+		sha256: sha256,
+		offset: offset,
+		transfer: transfer,
+	}
+
+	err = s.RunCommand(&upload)
+	if err != nil {
+		return err
+	}
+	return upload.err
 }
 
-func (s *Session) String() string {
-	return s.Hostname + " - " + s.Address + " - " + s.Os + "/" + s.Arch
+func (s *Session) downloadDirectory(transfer *Transfer) (*ArchiveResult, error) {
+
+	download := DownloadArchive{
+		localDirectory: transfer.Destination,
+		remoteDirectory: transfer.Source,
+		options: transfer.Options,
+		transfer: transfer,
+	}
+
+	err := s.RunCommand(&download)
+	if err != nil {
+		return nil, err
+	}
+	return download.result, download.err
 }
 
+func (s *Session) uploadDirectory(transfer *Transfer) (*ArchiveResult, error) {
 
-/* Private functions */
+	upload := UploadArchive{
+		localDirectory: transfer.Source,
+		remoteDirectory: transfer.Destination,
+		options: transfer.Options,
+		transfer: transfer,
+	}
 
-func (s *Session) runBackgroundCommand(command Command) {
-	s.jobs[s.newJobId()] = &command
-	go command.Start(s.session, &s.registry, s.logWriter)
+	err := s.RunCommand(&upload)
+	if err != nil {
+		return nil, err
+	}
+	return upload.result, upload.err
+}
+
+func (s *Session) runBackgroundCommand(command Command, call *Call) {
+	s.addJob(command)
+	go command.Start(call, &s.registry, s.logWriter)
 }
 
-func (s *Session) runInteractiveCommand(command Command) {
-	command.Start(s.session, &s.registry, s.logWriter)
+func (s *Session) runInteractiveCommand(command Command, call *Call) {
+	command.Start(call, &s.registry, s.logWriter)
 	command.Stop()
 }
 
-func (s *Session) newJobId() int {
+func (s *Session) addJob(command Command) int {
+	s.jobsLock.Lock()
+	defer s.jobsLock.Unlock()
+
 	s.jobIndex++
+	s.jobs[s.jobIndex] = &command
 	return s.jobIndex
 }
+
+// Jobs returns a copy of the background jobs by Id.
+func (s *Session) Jobs() map[int]Command {
+	s.jobsLock.Lock()
+	defer s.jobsLock.Unlock()
+
+	jobs := make(map[int]Command, len(s.jobs))
+	for id, job := range s.jobs {
+		jobs[id] = *job
+	}
+	return jobs
+}
+
+// removeJob forgets a job and returns it, nil when it is unknown.
+func (s *Session) removeJob(id int) Command {
+	s.jobsLock.Lock()
+	defer s.jobsLock.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil
+	}
+	delete(s.jobs, id)
+	return *job
+}
+
+// killer is implemented by the jobs outliving the session, which Stop
+// only forgets.
+type killer interface {
+	Kill() error
+}
+
+// KillJob stops a job and forgets it.
+func (s *Session) KillJob(id int) error {
+	job := s.removeJob(id)
+	if job == nil {
+		return errors.New("Invalid job Id")
+	}
+	if k, ok := job.(killer); ok {
+		return k.Kill()
+	}
+	job.Stop()
+	return nil
+}
@@ -0,0 +1,89 @@
+package gomet
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// ShellJob is the job of a named shell running on the agent while we
+// are detached from it. The shell outlives the session, it is only killed
+// by jobs kill or shell kill.
+type ShellJob struct {
+	session *Session
+	name string
+}
+
+func (j *ShellJob) GetRequest() *Request {
+	return nil
+}
+
+func (j *ShellJob) Start(call *Call, registry *Registry, logger *LogWriter) {
+}
+
+// Stop only forgets the shell, it keeps running on the agent.
+func (j *ShellJob) Stop() {
+}
+
+func (j *ShellJob) Kill() error {
+	return j.session.Request("shell.kill", ShellParams{Name: j.name}, nil)
+}
+
+func (j *ShellJob) IsJob() bool {
+	return true
+}
+
+func (j *ShellJob) String() string {
+	return "Shell " + j.name
+}
+
+/* -----------------
+   Named shells
+  ------------------ */
+
+func (s *Session) ListShells() ([]ShellInfo, error) {
+	var shells []ShellInfo
+	err := s.Request("shell.list", nil, &shells)
+	return shells, err
+}
+
+func (s *Session) KillShell(name string) error {
+	err := s.Request("shell.kill", ShellParams{Name: name}, nil)
+	if err != nil {
+		return err
+	}
+	s.trackShell(name, true)
+	return nil
+}
+
+// trackShell keeps a job for each named shell left running on the agent.
+func (s *Session) trackShell(name string, exited bool) {
+	for id, job := range s.Jobs() {
+		if shell, ok := job.(*ShellJob); ok && shell.name == name {
+			if exited {
+				s.removeJob(id)
+			}
+			return
+		}
+	}
+
+	if !exited {
+		s.RunCommand(&ShellJob{session: s, name: name})
+	}
+}
+
+func printShells(writer io.Writer, shells []ShellInfo) {
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	for _, shell := range shells {
+		status := "detached"
+		if shell.Attached {
+			status = "attached"
+		}
+		fmt.Fprintf(table, "%s\t%d\t%s\t%s\n",
+			shell.Name,
+			shell.Pid,
+			shell.StartTime.Local().Format("2006-01-02 15:04"),
+			status)
+	}
+	table.Flush()
+}
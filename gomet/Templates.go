@@ -0,0 +1,127 @@
+package gomet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	templatesDirectory = "templates"
+
+	// Reserved blob of the agent, see agent/Settings.go
+	agentSettingsMarker = "GoMetAgentSettings:9c41e07a2f5db"
+	agentSettingsSize   = 16384
+
+	// Room left for the client certificate and key, base64 PEM, which are
+	// issued once the settings are known to fit
+	agentCertificateSettingsSize = 2048
+)
+
+var templateTarget = regexp.MustCompile("^[a-z0-9]+$")
+
+// templatePath returns the prebuilt agent for a target, built by
+// build-templates.sh.
+func templatePath(goos string, goarch string) string {
+	name := "agent_" + goos + "_" + goarch
+	if goos == "windows" {
+		name += ".exe"
+	}
+	return filepath.Join(templatesDirectory, name)
+}
+
+func loadAgentTemplate(goos string, goarch string) ([]byte, error) {
+	if !templateTarget.MatchString(goos) || !templateTarget.MatchString(goarch) {
+		return nil, errors.New("Invalid target " + goos + "/" + goarch)
+	}
+
+	template, err := ioutil.ReadFile(templatePath(goos, goarch))
+	if os.IsNotExist(err) {
+		return nil, errors.New("No agent template for " + goos + "/" + goarch + ", available: " + strings.Join(AgentTemplates(), " "))
+	}
+	return template, err
+}
+
+// agentSettingsOffset returns where the reserved blob of the template starts.
+func agentSettingsOffset(template []byte) (int, error) {
+	marker := []byte(agentSettingsMarker)
+
+	index := bytes.Index(template, marker)
+	if index < 0 || bytes.Index(template[index + len(marker):], marker) >= 0 {
+		return 0, errors.New("The agent template must contain its settings marker once")
+	}
+	if index + agentSettingsSize > len(template) {
+		return 0, errors.New("Truncated agent template")
+	}
+	return index, nil
+}
+
+func encodeAgentSettings(settings map[string]string, reserved int) ([]byte, error) {
+	content, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	if len(agentSettingsMarker) + 4 + len(content) + reserved > agentSettingsSize {
+		return nil, errors.New("The agent settings are too large")
+	}
+	return content, nil
+}
+
+// checkAgentTemplate checks the template can be patched with the settings,
+// before the client certificate is added to them.
+func checkAgentTemplate(template []byte, settings map[string]string) error {
+	_, err := agentSettingsOffset(template)
+	if err != nil {
+		return err
+	}
+	_, err = encodeAgentSettings(settings, agentCertificateSettingsSize)
+	return err
+}
+
+// patchAgentTemplate returns a copy of the template with the settings in
+// its reserved blob.
+func patchAgentTemplate(template []byte, settings map[string]string) ([]byte, error) {
+	index, err := agentSettingsOffset(template)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := encodeAgentSettings(settings, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	agent := make([]byte, len(template))
+	copy(agent, template)
+
+	blob := agent[index + len(agentSettingsMarker):index + agentSettingsSize]
+	for i := range blob {
+		blob[i] = 0
+	}
+	binary.BigEndian.PutUint32(blob, uint32(len(content)))
+	copy(blob[4:], content)
+	return agent, nil
+}
+
+// AgentTemplates returns the available targets, os/arch.
+func AgentTemplates() []string {
+	files, _ := filepath.Glob(filepath.Join(templatesDirectory, "agent_*"))
+
+	var targets []string
+	for _, file := range files {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "agent_"), ".exe")
+		parts := strings.SplitN(name, "_", 2)
+		if len(parts) == 2 {
+			targets = append(targets, parts[0] + "/" + parts[1])
+		}
+	}
+	sort.Strings(targets)
+	return targets
+}
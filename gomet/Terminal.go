@@ -0,0 +1,47 @@
+package gomet
+
+import (
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"os"
+	"sync"
+)
+
+// localTerminal is the terminal of the controller during an interactive
+// shell. Input is passed raw so control keys reach the remote pty.
+type localTerminal struct {
+	fd int
+	state *terminal.State
+	restoreOnce sync.Once
+}
+
+// newLocalTerminal returns nil when reader is not a terminal.
+func newLocalTerminal(reader io.Reader) *localTerminal {
+	file, ok := reader.(*os.File)
+	if !ok || !terminal.IsTerminal(int(file.Fd())) {
+		return nil
+	}
+	return &localTerminal{fd: int(file.Fd())}
+}
+
+func (t *localTerminal) makeRaw() error {
+	var err error
+	t.state, err = terminal.MakeRaw(t.fd)
+	return err
+}
+
+func (t *localTerminal) restore() {
+	t.restoreOnce.Do(func() {
+		if t.state != nil {
+			terminal.Restore(t.fd, t.state)
+		}
+	})
+}
+
+func (t *localTerminal) size() (WindowSize, error) {
+	width, height, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return WindowSize{}, err
+	}
+	return WindowSize{Rows: uint16(height), Cols: uint16(width)}, nil
+}
@@ -0,0 +1,28 @@
+// +build !windows
+
+package gomet
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchResize calls resize with the new window size on each SIGWINCH until stop is closed.
+func watchResize(t *localTerminal, stop chan struct{}, resize func(WindowSize)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGWINCH)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-signals:
+			size, err := t.size()
+			if err == nil {
+				resize(size)
+			}
+		}
+	}
+}
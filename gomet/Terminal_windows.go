@@ -0,0 +1,27 @@
+// +build windows
+
+package gomet
+
+import (
+	"time"
+)
+
+// watchResize polls the window size as there is no SIGWINCH on Windows.
+func watchResize(t *localTerminal, stop chan struct{}, resize func(WindowSize)) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	last, _ := t.size()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			size, err := t.size()
+			if err == nil && size != last {
+				last = size
+				resize(size)
+			}
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package gomet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	TransferDownload = "download"
+	TransferUpload   = "upload"
+
+	// maxFinishedTransfers finished transfers are kept per session
+	maxFinishedTransfers = 20
+)
+
+// Transfer follows a file or directory transfer of a session. Commands
+// write the data they transfer to it to update the counters.
+type Transfer struct {
+	Id          int
+	Type        string
+	Source      string
+	Destination string
+	Options     ArchiveOptions
+
+	lock        sync.Mutex
+	directory   bool
+	size        int64
+	offset      int64
+	transferred int64
+	startTime   time.Time
+	endTime     time.Time
+	result      *ArchiveResult
+	err         error
+}
+
+// TransferProgress is a snapshot of a transfer. Size is 0 when unknown,
+// as for directories, Eta is in seconds.
+type TransferProgress struct {
+	Id          int            `json:"id"`
+	Type        string         `json:"type"`
+	Source      string         `json:"source"`
+	Destination string         `json:"destination"`
+	Directory   bool           `json:"directory"`
+	Size        int64          `json:"size"`
+	Offset      int64          `json:"offset"`
+	Transferred int64          `json:"transferred"`
+	Rate        float64        `json:"rate"`
+	Eta         int64          `json:"eta"`
+	StartTime   time.Time      `json:"startTime"`
+	Done        bool           `json:"done"`
+	Result      *ArchiveResult `json:"result,omitempty"`
+	Error       string         `json:"error,omitempty"`
+}
+
+func (t *Transfer) setDirectory() {
+	t.lock.Lock()
+	t.directory = true
+	t.lock.Unlock()
+}
+
+// start is called once the size of the data and where it resumes are known.
+func (t *Transfer) start(size int64, offset int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.size = size
+	t.offset = offset
+	t.transferred = offset
+	t.startTime = time.Now()
+}
+
+func (t *Transfer) Write(data []byte) (int, error) {
+	t.lock.Lock()
+	t.transferred += int64(len(data))
+	t.lock.Unlock()
+	return len(data), nil
+}
+
+func (t *Transfer) finish(result *ArchiveResult, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.result = result
+	t.err = err
+	t.endTime = time.Now()
+}
+
+func (t *Transfer) done() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return !t.endTime.IsZero()
+}
+
+func (t *Transfer) Progress() TransferProgress {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	progress := TransferProgress{
+		Id: t.Id,
+		Type: t.Type,
+		Source: t.Source,
+		Destination: t.Destination,
+		Directory: t.directory,
+		Size: t.size,
+		Offset: t.offset,
+		Transferred: t.transferred,
+		StartTime: t.startTime,
+		Done: !t.endTime.IsZero(),
+		Result: t.result,
+	}
+
+	if t.err != nil {
+		progress.Error = t.err.Error()
+	}
+
+	if !t.startTime.IsZero() {
+		end := t.endTime
+		if end.IsZero() {
+			end = time.Now()
+		}
+		elapsed := end.Sub(t.startTime).Seconds()
+		if elapsed > 0 {
+			progress.Rate = float64(t.transferred - t.offset) / elapsed
+		}
+	}
+
+	if !progress.Done && progress.Rate > 0 && t.size > t.transferred {
+		progress.Eta = int64(float64(t.size - t.transferred) / progress.Rate)
+	}
+	return progress
+}
+
+func (p TransferProgress) String() string {
+	line := formatBytes(p.Transferred)
+	if p.Size > 0 {
+		line += fmt.Sprintf(" / %s (%d%%)", formatBytes(p.Size), p.Transferred * 100 / p.Size)
+	}
+	line += fmt.Sprintf(" %s/s", formatBytes(int64(p.Rate)))
+	if p.Eta > 0 {
+		line += fmt.Sprintf(" ETA %s", time.Duration(p.Eta) * time.Second)
+	}
+	return line
+}
+
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size)
+	units := "KMGTPE"
+	i := -1
+	for value >= unit && i < len(units) - 1 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, units[i])
+}
+
+// printProgress prints the progress of the transfer on a single line until done is closed.
+func printProgress(writer io.Writer, transfer *Transfer, done chan struct{}) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			fmt.Fprintf(writer, "\r\033[K%s\n", transfer.Progress())
+			return
+		case <-ticker.C:
+			fmt.Fprintf(writer, "\r\033[K%s", transfer.Progress())
+		}
+	}
+}
+
+func printTransfers(writer io.Writer, transfers []TransferProgress) {
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	for _, transfer := range transfers {
+		status := "running"
+		if transfer.Error != "" {
+			status = "failed: " + transfer.Error
+		} else if transfer.Done {
+			status = "done"
+		}
+		fmt.Fprintf(table, "%d\t%s\t%s -> %s\t%s\t%s\n",
+			transfer.Id,
+			transfer.Type,
+			transfer.Source,
+			transfer.Destination,
+			transfer.String(),
+			status)
+	}
+	table.Flush()
+}
+
+
+/* -----------------
+   Session
+  ------------------ */
+
+// NewTransfer registers a transfer, RunTransfer does it.
+func (s *Session) NewTransfer(transferType string, source string, destination string, options ArchiveOptions) (*Transfer, error) {
+	if transferType != TransferDownload && transferType != TransferUpload {
+		return nil, errors.New("Invalid transfer type " + transferType)
+	}
+
+	s.transfersLock.Lock()
+	defer s.transfersLock.Unlock()
+
+	s.transferIndex++
+	transfer := &Transfer{
+		Id: s.transferIndex,
+		Type: transferType,
+		Source: source,
+		Destination: destination,
+		Options: options,
+	}
+	s.transfers[transfer.Id] = transfer
+	return transfer, nil
+}
+
+// RunTransfer transfers a file, or a directory as an archive.
+func (s *Session) RunTransfer(transfer *Transfer) error {
+	var result *ArchiveResult
+	var err error
+
+	if transfer.Type == TransferDownload {
+		var entry *FileEntry
+		entry, err = s.StatFile(transfer.Source)
+		if err == nil && entry.IsDir {
+			transfer.setDirectory()
+			result, err = s.downloadDirectory(transfer)
+		} else if err == nil {
+			err = s.downloadFile(transfer)
+		}
+	} else {
+		var info os.FileInfo
+		info, err = os.Stat(transfer.Source)
+		if err == nil && info.IsDir() {
+			transfer.setDirectory()
+			result, err = s.uploadDirectory(transfer)
+		} else if err == nil {
+			err = s.uploadFile(transfer)
+		}
+	}
+
+	s.finishTransfer(transfer, result, err)
+	return err
+}
+
+// finishTransfer records the end of the transfer and forgets the oldest
+// finished transfers beyond maxFinishedTransfers.
+func (s *Session) finishTransfer(transfer *Transfer, result *ArchiveResult, err error) {
+	transfer.finish(result, err)
+
+	s.transfersLock.Lock()
+	defer s.transfersLock.Unlock()
+
+	finished := make([]int, 0, len(s.transfers))
+	for id, transfer := range s.transfers {
+		if transfer.done() {
+			finished = append(finished, id)
+		}
+	}
+
+	if len(finished) <= maxFinishedTransfers {
+		return
+	}
+
+	sort.Ints(finished)
+	for _, id := range finished[:len(finished) - maxFinishedTransfers] {
+		delete(s.transfers, id)
+	}
+}
+
+func (s *Session) GetTransfer(id int) (*Transfer, error) {
+	s.transfersLock.Lock()
+	defer s.transfersLock.Unlock()
+
+	transfer, ok := s.transfers[id]
+	if !ok {
+		return nil, errors.New("Invalid transfer Id")
+	}
+	return transfer, nil
+}
+
+func (s *Session) Transfers() []TransferProgress {
+	s.transfersLock.Lock()
+	defer s.transfersLock.Unlock()
+
+	transfers := make([]TransferProgress, 0, len(s.transfers))
+	for _, transfer := range s.transfers {
+		transfers = append(transfers, transfer.Progress())
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].Id < transfers[j].Id
+	})
+	return transfers
+}
@@ -2,25 +2,26 @@ package gomet
 
 import (
 	"bufio"
+	"errors"
+	"flag"
+	"fmt"
 	"github.com/abiosoft/ishell"
 	"github.com/xtaci/smux"
 	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 	"sync"
 )
 
-func acceptNewStream(session *smux.Session) *smux.Stream {
-	stream, err := session.AcceptStream()
-	if err != nil {
-		log.Printf("ERROR %s", err)
-		return nil
-	}
-	log.Printf("New stream opened")
-	return stream
+func reportError(writer io.Writer, err error) {
+	log.Printf("ERROR %s", err)
+	fmt.Fprintf(writer, "Error: %s\n", err)
 }
 
 func readParameter(c *ishell.Context, name string) string {
@@ -28,6 +29,82 @@ func readParameter(c *ishell.Context, name string) string {
 	return c.ReadLine()
 }
 
+// readDefaultParameter reads a value, defaultValue when the answer is empty
+// and an empty value when it is "none".
+func readDefaultParameter(c *ishell.Context, name string, defaultValue string) string {
+	value := strings.TrimSpace(readParameter(c, name + " [" + defaultValue + "]: "))
+	if value == "" {
+		return defaultValue
+	}
+	if value == "none" {
+		return ""
+	}
+	return value
+}
+
+// readIntParameter reads a positive number, defaultValue when the answer is empty or invalid.
+func readIntParameter(c *ishell.Context, name string, defaultValue int) int {
+	value, err := strconv.Atoi(readParameter(c, name + " [" + strconv.Itoa(defaultValue) + "]: "))
+	if err != nil || value < 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// parseFlag removes flag from args and tells if it was present.
+func parseFlag(args []string, flag string) (bool, []string) {
+	found := false
+	result := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == flag {
+			found = true
+		} else {
+			result = append(result, arg)
+		}
+	}
+	return found, result
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func parseArchiveOptions(args []string) (ArchiveOptions, []string, error) {
+	var options ArchiveOptions
+	var include, exclude stringList
+
+	flags := flag.NewFlagSet("archive", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.StringVar(&options.Compression, "z", CompressionNone, "compression")
+	flags.Var(&include, "i", "include glob")
+	flags.Var(&exclude, "x", "exclude glob")
+
+	err := flags.Parse(args)
+	options.Include = include
+	options.Exclude = exclude
+	return options, flags.Args(), err
+}
+
+// parseExecuteOptions parses [-t <seconds>] <command>, 0 disables the timeout.
+func parseExecuteOptions(args []string, timeout time.Duration) (time.Duration, string, error) {
+	flags := flag.NewFlagSet("execute", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	seconds := flags.Int("t", int(timeout / time.Second), "timeout in seconds")
+
+	err := flags.Parse(args)
+	if err == nil && *seconds < 0 {
+		err = errors.New("Invalid timeout")
+	}
+	return time.Duration(*seconds) * time.Second, strings.Join(flags.Args(), " "), err
+}
+
 func handleConnection(conn net.Conn, stream *smux.Stream, registry *Registry) {
 
 	registry.Register(stream)